@@ -132,7 +132,7 @@ func (b stdBag) Cookie(e env.Environ[string]) (*http.Cookie, error) {
 		case "http-only":
 			cook.HttpOnly, err = vs[0].ExpandBool(e)
 		default:
-			return nil, fmt.Errorf("%s: invalid cookie property")
+			return nil, fmt.Errorf("%s: invalid cookie property", k)
 		}
 		if err != nil {
 			return nil, err
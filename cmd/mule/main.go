@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -14,6 +15,11 @@ func main() {
 	var (
 		file   = flag.String("f", "sample.mu", "read request from file")
 		print  = flag.Bool("p", false, "print response to stdout")
+		env    = flag.String("e", "", "use the variables of the given environment")
+		dry    = flag.Bool("n", false, "print requests without sending them")
+		har    = flag.String("har", "", "record requests and responses into a HAR file")
+		debug  = flag.Bool("v", false, "print requests and responses headers to stderr")
+		secret = flag.Bool("s", false, "do not redact credentials in verbose mode")
 		listen = flag.Bool("l", false, "listen")
 		addr   = flag.String("a", ":9000", "listening address")
 	)
@@ -25,18 +31,43 @@ func main() {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	if *listen {
+	if *env != "" {
+		if err := c.SetEnvironment(*env); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *debug {
+		c.Verbose(os.Stderr, *secret)
+	}
+	switch {
+	case *listen:
 		err = runListen(c, *addr)
-	} else {
-		err = runExecute(c, *print)
+	case *dry:
+		err = c.DryRun(flag.Arg(0), os.Stdout)
+	default:
+		err = runExecute(c, *print, *har)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	os.Exit(exitCode(err))
+}
+
+// exitCode gives the status mule exits with. A skipped request is not an
+// error.
+func exitCode(err error) int {
+	if err == nil || errors.Is(err, mule.ErrSkipped) {
+		return 0
 	}
+	return 1
 }
 
 func runListen(c *mule.Collection, addr string) error {
 	return http.ListenAndServe(addr, nil)
 }
 
-func runExecute(c *mule.Collection, print bool) error {
+func runExecute(c *mule.Collection, print bool, har string) error {
 	var (
 		out io.Writer = io.Discard
 		err error
@@ -46,8 +77,19 @@ func runExecute(c *mule.Collection, print bool) error {
 	}
 	switch flag.Arg(0) {
 	case "help":
+	case "curl":
+		err = c.Curl(flag.Arg(1), os.Stdout)
 	default:
-		err = c.Run(flag.Arg(0), out)
+		if har == "" {
+			err = c.Run(flag.Arg(0), out)
+			break
+		}
+		var f *os.File
+		if f, err = os.Create(har); err != nil {
+			break
+		}
+		defer f.Close()
+		err = c.Record(flag.Arg(0), out, f)
 	}
 	return err
 }
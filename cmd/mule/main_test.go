@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/midbel/mule"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		Err  error
+		Want int
+	}{
+		{Err: nil, Want: 0},
+		{Err: mule.ErrSkipped, Want: 0},
+		{Err: fmt.Errorf("login: %w", mule.ErrSkipped), Want: 0},
+		{Err: errors.New("login: request not defined"), Want: 1},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.Err); got != tt.Want {
+			t.Errorf("%v: exit code mismatched! want %d, got %d", tt.Err, tt.Want, got)
+		}
+	}
+}
@@ -2,16 +2,25 @@ package mule
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/midbel/enjoy/env"
 	"github.com/midbel/enjoy/value"
 )
 
+// ErrSkipped is returned when a request is not executed because of its when or
+// skipIf condition.
+var ErrSkipped = errors.New("request skipped")
+
 type Info struct {
 	Name     string
 	Usage    string
@@ -25,18 +34,85 @@ type Collection struct {
 
 	parent *Collection
 
-	config      *tls.Config
+	config      *tlsConfig
+	transport   *transportConfig
+	rate        *rateLimit
+	proxy       Word
+	noproxy     []Word
 	base        Word
 	user        Word
 	pass        Word
 	env         env.Environ[string]
+	names       []string
+	profiles    []*Collection
+	profile     *Collection
 	headers     Bag
+	defaults    Bag
+	forced      Bag
 	query       Bag
+	cookies     []Bag
 	requests    []Request
 	collections []*Collection
 
+	before     []value.Evaluable
+	after      []value.Evaluable
 	afterEach  []value.Evaluable
 	beforeEach []value.Evaluable
+
+	verbose io.Writer
+	secrets bool
+}
+
+type transportConfig struct {
+	maxIdle        int
+	maxIdlePerHost int
+	maxConnPerHost int
+	idleTimeout    time.Duration
+	noKeepAlive    bool
+	noHttp2        bool
+}
+
+// rateLimit enforces a minimum interval between the requests of the
+// collections sharing it.
+type rateLimit struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+var sleep = time.Sleep
+
+func (r *rateLimit) Wait() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := timeSource()
+	if wait := r.next.Sub(now); wait > 0 {
+		sleep(wait)
+		now = r.next
+	}
+	r.next = now.Add(r.interval)
+}
+
+func (t *transportConfig) Configure(tr *http.Transport) {
+	if t.maxIdle > 0 {
+		tr.MaxIdleConns = t.maxIdle
+	}
+	if t.maxIdlePerHost > 0 {
+		tr.MaxIdleConnsPerHost = t.maxIdlePerHost
+	}
+	if t.maxConnPerHost > 0 {
+		tr.MaxConnsPerHost = t.maxConnPerHost
+	}
+	if t.idleTimeout > 0 {
+		tr.IdleConnTimeout = t.idleTimeout
+	}
+	tr.DisableKeepAlives = t.noKeepAlive
+	if t.noHttp2 {
+		tr.ForceAttemptHTTP2 = false
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
 }
 
 func Open(file string) (*Collection, error) {
@@ -87,7 +163,77 @@ func (c *Collection) Path() []string {
 	return parts
 }
 
+// Verbose makes the runs of the collection write the requests sent and the
+// responses received to w. Credentials are only shown when secrets is set.
+func (c *Collection) Verbose(w io.Writer, secrets bool) {
+	c.verbose = w
+	c.secrets = secrets
+}
+
 func (c *Collection) Run(name string, w io.Writer) error {
+	ctx, err := MuleContext(c)
+	if err != nil {
+		return err
+	}
+	return c.run(ctx, name, w)
+}
+
+// Record runs the given request like Run and writes the requests sent and the
+// responses received as an HTTP archive to har.
+func (c *Collection) Record(name string, w, har io.Writer) error {
+	ctx, err := MuleContext(c)
+	if err != nil {
+		return err
+	}
+	ctx.har = &harRecorder{}
+	err = c.run(ctx, name, w)
+	if e := ctx.har.Encode(har); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// DryRun writes the requests that would be sent by Run (including the
+// dependencies of the request) without sending them.
+func (c *Collection) DryRun(name string, w io.Writer) error {
+	ctx, err := MuleContext(c)
+	if err != nil {
+		return err
+	}
+	ctx.dry = true
+	return c.run(ctx, name, w)
+}
+
+// Curl writes the curl command equivalent to the given request.
+func (c *Collection) Curl(name string, w io.Writer) error {
+	other, q, err := c.lookup(name)
+	if err != nil {
+		return err
+	}
+	ctx, err := MuleContext(other)
+	if err != nil {
+		return err
+	}
+	return q.Curl(ctx, w)
+}
+
+func (c *Collection) lookup(name string) (*Collection, Request, error) {
+	if c.Disabled {
+		return nil, Request{}, fmt.Errorf("%s: collection disabled", c.Name)
+	}
+	name, rest, found := strings.Cut(name, ".")
+	if !found {
+		q, err := c.GetRequest(name)
+		return c, q, err
+	}
+	other, err := c.GetCollection(name)
+	if err != nil {
+		return nil, Request{}, err
+	}
+	return other.lookup(rest)
+}
+
+func (c *Collection) run(ctx *Context, name string, w io.Writer) error {
 	if c.Disabled {
 		return fmt.Errorf("%s: collection disabled", c.Name)
 	}
@@ -101,36 +247,70 @@ func (c *Collection) Run(name string, w io.Writer) error {
 		if err != nil {
 			return err
 		}
-		return c.execute(q, w)
+		return c.execute(ctx, q, w)
 	}
 	other, err := c.GetCollection(name)
 	if err != nil {
 		return err
 	}
-	return other.Run(rest, w)
+	return other.run(ctx, rest, w)
 }
 
-func (c *Collection) execute(q Request, w io.Writer) error {
-	depends, err := q.Depends(c)
-	if err != nil {
+// execute runs the dependencies of the request before running the request
+// itself. The bodies of the responses of the dependencies are discarded except
+// in dry run mode where all the requests are written to w.
+func (c *Collection) execute(parent *Context, q Request, w io.Writer) (err error) {
+	parts := c.Path()
+	slices.Reverse(parts)
+	key := strings.TrimPrefix(strings.Join(append(parts, q.Name), "."), ".")
+	if ok, err := parent.deps.Enter(key); err != nil || !ok {
 		return err
 	}
-	ctx, err := MuleContext(c)
+	defer func() {
+		parent.deps.Leave(key, err == nil)
+	}()
+
+	depends, err := q.Depends(c)
 	if err != nil {
 		return err
 	}
+	sub := io.Discard
+	if parent.dry {
+		sub = w
+	}
 	for _, d := range depends {
-		if err := c.Run(d, w); err != nil {
+		if err := c.run(parent, d, sub); err != nil && !errors.Is(err, ErrSkipped) {
 			return err
 		}
 	}
+	ctx, err := parent.Enclosed(c)
+	if err != nil {
+		return err
+	}
+	if ok, err := q.Runnable(ctx); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%s: %w", q.Name, ErrSkipped)
+	}
+	if ctx.dry {
+		return q.Dump(ctx, w)
+	}
 	res, err := q.Execute(ctx)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
-	io.Copy(w, res.Body)
-	return nil
+
+	out, err := q.openOutput(ctx)
+	if err != nil {
+		return err
+	}
+	if out != nil {
+		defer out.Close()
+		w = io.MultiWriter(w, out)
+	}
+	_, err = io.Copy(w, res.Body)
+	return err
 }
 
 func (c *Collection) GetCollection(name string) (*Collection, error) {
@@ -151,6 +331,18 @@ func (c *Collection) GetCollection(name string) (*Collection, error) {
 	} else {
 		other.headers = c.headers
 	}
+	if other.config == nil {
+		other.config = c.config
+	}
+	if other.transport == nil {
+		other.transport = c.transport
+	}
+	if other.rate == nil {
+		other.rate = c.rate
+	}
+	if other.proxy == nil {
+		other.proxy, other.noproxy = c.proxy, c.noproxy
+	}
 	return other, nil
 }
 
@@ -172,22 +364,46 @@ func (c *Collection) GetRequest(name string) (Request, error) {
 	if req.Disabled {
 		return req, fmt.Errorf("%s: request disabled", name)
 	}
-	if c.base != nil {
-		var ws compound
-		ws = append(ws, c.base)
-		if w, ok := req.location.(compound); ok {
-			ws = append(ws, w...)
-		} else {
-			ws = append(ws, req.location)
-		}
-		req.location = ws
+	for p := c; p != nil; p = p.parent {
+		req.location = createMergedURL(p.base, req.location)
 	}
+	req.cookies = append(req.cookies, c.cookies...)
 	req.query = req.query.Merge(c.query)
 	req.headers = req.headers.Merge(c.headers)
 	return req, nil
 }
 
+// SetEnvironment activates the variables of the environment with the given name
+// in the collection and its sub collections. The variables of an environment
+// take precedence over the variables of the collection defining it.
+func (c *Collection) SetEnvironment(name string) error {
+	if !c.setEnvironment(name) {
+		return fmt.Errorf("%s: environment not defined", name)
+	}
+	return nil
+}
+
+func (c *Collection) setEnvironment(name string) bool {
+	var found bool
+	c.profile = nil
+	for _, e := range c.profiles {
+		if e.Name == name {
+			c.profile, found = e, true
+			break
+		}
+	}
+	for _, sub := range c.collections {
+		found = sub.setEnvironment(name) || found
+	}
+	return found
+}
+
 func (c *Collection) Resolve(key string) (string, error) {
+	if c.profile != nil {
+		if v, err := c.profile.env.Resolve(key); err == nil {
+			return v, err
+		}
+	}
 	v, err := c.env.Resolve(key)
 	if err == nil {
 		return v, err
@@ -199,6 +415,9 @@ func (c *Collection) Resolve(key string) (string, error) {
 }
 
 func (c *Collection) Define(key, value string, _ bool) error {
+	if !slices.Contains(c.names, key) {
+		c.names = append(c.names, key)
+	}
 	c.env.Define(key, value, false)
 	return nil
 }
@@ -211,6 +430,10 @@ func (c *Collection) AddRequest(req Request) {
 	c.requests = append(c.requests, req)
 }
 
+func (c *Collection) AddEnvironment(env *Collection) {
+	c.profiles = append(c.profiles, env)
+}
+
 func (c *Collection) AddCollection(col *Collection) {
 	if col.parent == nil {
 		col.parent = c
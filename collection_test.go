@@ -0,0 +1,362 @@
+package mule
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/midbel/enjoy/env"
+	"github.com/midbel/enjoy/value"
+)
+
+func TestRunSharesCookies(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "foobar", Path: "/"})
+	})
+	mux.HandleFunc("/profile", func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie("session")
+		if err != nil || c.Value != "foobar" {
+			http.Error(w, "session cookie missing", http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, "profile")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	src := `
+collection users {
+	url %q
+	post login {
+		url '/login'
+		expect 200
+	}
+	get profile {
+		depends login
+		url '/profile'
+		expect 200
+	}
+}
+`
+	c, err := parseString(fmt.Sprintf(src, srv.URL))
+	if err != nil {
+		t.Fatalf("unexpected error parsing collection: %s", err)
+	}
+	if err := c.Run("users.profile", io.Discard); err != nil {
+		t.Fatalf("cookie not shared between requests: %s", err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("%s %s: request sent during a dry run", r.Method, r.URL)
+	}))
+	defer srv.Close()
+
+	src := `
+url %q
+post login {
+	url '/login'
+	body '{"user": "mule"}'
+}
+get profile {
+	depends login
+	url '/profile'
+	headers {
+		accept 'application/json'
+	}
+}
+`
+	c, err := parseString(fmt.Sprintf(src, srv.URL))
+	if err != nil {
+		t.Fatalf("unexpected error parsing collection: %s", err)
+	}
+	var out strings.Builder
+	if err := c.DryRun("profile", &out); err != nil {
+		t.Fatalf("unexpected error running request: %s", err)
+	}
+	wants := []string{
+		"POST /login HTTP/1.1",
+		`{"user": "mule"}`,
+		"GET /profile HTTP/1.1",
+		"Accept: application/json",
+	}
+	for _, w := range wants {
+		if !strings.Contains(out.String(), w) {
+			t.Errorf("%s: missing from dry run output\n%s", w, out.String())
+		}
+	}
+	if strings.Index(out.String(), "POST") > strings.Index(out.String(), "GET") {
+		t.Errorf("dependency should be written first\n%s", out.String())
+	}
+}
+
+func TestRunSkipped(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		hits = make(map[string]int)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		hits[r.URL.Path]++
+	}))
+	defer srv.Close()
+
+	src := `
+url %q
+get login {
+	url '/login'
+}
+get refresh {
+	url '/refresh'
+}
+get profile {
+	depends login refresh
+	url '/profile'
+}
+`
+	c, err := parseString(fmt.Sprintf(src, srv.URL))
+	if err != nil {
+		t.Fatalf("unexpected error parsing collection: %s", err)
+	}
+	findRequest(t, c, "login").when = constScript(false)
+	findRequest(t, c, "refresh").skip = constScript(true)
+
+	for _, name := range []string{"login", "refresh"} {
+		if err := c.Run(name, io.Discard); !errors.Is(err, ErrSkipped) {
+			t.Errorf("%s: skipped error expected, got %v", name, err)
+		}
+	}
+	if err := c.Run("profile", io.Discard); err != nil {
+		t.Fatalf("dependent request should run when its dependencies are skipped: %s", err)
+	}
+	want := map[string]int{"/profile": 1}
+	if !maps.Equal(hits, want) {
+		t.Errorf("requests sent mismatched! want %v, got %v", want, hits)
+	}
+}
+
+func TestRunDependencies(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		hits = make(map[string]int)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		if r.URL.Path == "/login" {
+			io.WriteString(w, "secret")
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "token missing", http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, strings.TrimPrefix(r.URL.Path, "/"))
+	}))
+	defer srv.Close()
+
+	src := `
+url %q
+headers {
+	authorization "Bearer ${token:-none}"
+}
+post login {
+	url '/login'
+	expect 200
+}
+get profile {
+	depends login
+	url '/profile'
+	expect 200
+}
+get orders {
+	depends login profile
+	url '/orders'
+	expect 200
+}
+`
+	c, err := parseString(fmt.Sprintf(src, srv.URL))
+	if err != nil {
+		t.Fatalf("unexpected error parsing collection: %s", err)
+	}
+	findRequest(t, c, "login").after = scriptFunc(func(ctx *Context, ev env.Environ[value.Value]) error {
+		body, err := ev.Resolve(resBody)
+		if err != nil {
+			return err
+		}
+		args := []value.Value{
+			value.CreateString("token"),
+			body,
+		}
+		_, err = ctx.vars.Call("set", args)
+		return err
+	})
+	var out strings.Builder
+	if err := c.Run("orders", &out); err != nil {
+		t.Fatalf("unexpected error running request: %s", err)
+	}
+	if out.String() != "orders" {
+		t.Errorf("bodies of dependencies should be discarded! got %s", out.String())
+	}
+	want := map[string]int{"/login": 1, "/profile": 1, "/orders": 1}
+	if !maps.Equal(hits, want) {
+		t.Errorf("requests sent mismatched! want %v, got %v", want, hits)
+	}
+}
+
+func TestRunDependencyCycle(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("%s: request sent with a dependency cycle", r.URL.Path)
+	}))
+	defer srv.Close()
+
+	src := `
+url %q
+get first {
+	depends third
+	url '/first'
+}
+get second {
+	depends first
+	url '/second'
+}
+get third {
+	depends second
+	url '/third'
+}
+`
+	c, err := parseString(fmt.Sprintf(src, srv.URL))
+	if err != nil {
+		t.Fatalf("unexpected error parsing collection: %s", err)
+	}
+	err = c.Run("first", io.Discard)
+	if err == nil {
+		t.Fatalf("expected error but request succeeded")
+	}
+	if want := "dependency cycle detected: first -> third -> second -> first"; err.Error() != want {
+		t.Errorf("error mismatched! want %s, got %s", want, err)
+	}
+}
+
+func TestSetEnvironment(t *testing.T) {
+	src := `
+variables {
+	host  localhost
+	token none
+}
+environment staging {
+	variables {
+		host 'staging.example.com'
+	}
+}
+collection users {
+	variables {
+		limit 10
+	}
+	environment staging {
+		variables {
+			limit 100
+		}
+	}
+	get list {
+		url "http://${host}/users"
+	}
+}
+`
+	c, err := parseString(src)
+	if err != nil {
+		t.Fatalf("unexpected error parsing collection: %s", err)
+	}
+	sub, err := c.GetCollection("users")
+	if err != nil {
+		t.Fatalf("users: collection not found")
+	}
+	check := func(ev env.Environ[string], key, want string) {
+		t.Helper()
+		got, err := ev.Resolve(key)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", key, err)
+			return
+		}
+		if got != want {
+			t.Errorf("%s: value mismatched! want %s, got %s", key, want, got)
+		}
+	}
+	check(c, "host", "localhost")
+	check(sub, "host", "localhost")
+	check(sub, "limit", "10")
+
+	if err := c.SetEnvironment("staging"); err != nil {
+		t.Fatalf("staging: unexpected error: %s", err)
+	}
+	check(c, "host", "staging.example.com")
+	check(c, "token", "none")
+	check(sub, "host", "staging.example.com")
+	check(sub, "limit", "100")
+
+	if err := c.SetEnvironment("production"); err == nil {
+		t.Errorf("production: expected error for unknown environment")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	defer func(s func(time.Duration), n func() time.Time) {
+		sleep, timeSource = s, n
+	}(sleep, timeSource)
+
+	var (
+		start = time.Date(2024, 3, 15, 10, 0, 0, 0, time.UTC)
+		now   = start
+		slept []time.Duration
+	)
+	timeSource = func() time.Time {
+		return now
+	}
+	sleep = func(d time.Duration) {
+		slept = append(slept, d)
+		now = now.Add(d)
+	}
+
+	const (
+		count    = 5
+		interval = 100 * time.Millisecond
+	)
+	rate := rateLimit{
+		interval: interval,
+	}
+	var sent []time.Time
+	for i := 0; i < count; i++ {
+		rate.Wait()
+		sent = append(sent, now)
+		now = now.Add(10 * time.Millisecond)
+	}
+	if elapsed := sent[len(sent)-1].Sub(start); elapsed < (count-1)*interval {
+		t.Errorf("requests sent too fast! want at least %s, got %s", (count-1)*interval, elapsed)
+	}
+	for i := 1; i < len(sent); i++ {
+		if diff := sent[i].Sub(sent[i-1]); diff < interval {
+			t.Errorf("request %d: interval too short! want %s, got %s", i, interval, diff)
+		}
+	}
+	if len(slept) != count-1 {
+		t.Errorf("sleeps mismatched! want %d, got %d", count-1, len(slept))
+	}
+
+	now = now.Add(time.Second)
+	slept = slept[:0]
+	rate.Wait()
+	if len(slept) != 0 {
+		t.Errorf("request should not wait after an idle period! slept %s", slept)
+	}
+}
@@ -1,12 +1,23 @@
 package mule
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/midbel/enjoy/env"
 	"github.com/midbel/enjoy/eval"
@@ -25,20 +36,169 @@ const (
 
 type Context struct {
 	value.Global
-	root *Collection
+	root    *Collection
+	vars    *muleVars
+	environ envVars
+	jar     http.CookieJar
+	clients map[clientKey]*http.Client
+	deps    *depsTracker
+	verbose *logger
+	har     *harRecorder
+	dry     bool
+}
+
+// depsTracker keeps the requests executed during a run and the ones being
+// executed in order to run a dependency only once and to detect cycles.
+type depsTracker struct {
+	running []string
+	done    map[string]struct{}
+}
+
+func (d *depsTracker) Enter(key string) (bool, error) {
+	if _, ok := d.done[key]; ok {
+		return false, nil
+	}
+	if i := slices.Index(d.running, key); i >= 0 {
+		cycle := append(slices.Clone(d.running[i:]), key)
+		return false, fmt.Errorf("dependency cycle detected: %s", strings.Join(cycle, " -> "))
+	}
+	d.running = append(d.running, key)
+	return true, nil
+}
+
+// Leave marks the request as not running anymore. A request that failed is
+// not marked as done and can be run again by another request depending on it.
+func (d *depsTracker) Leave(key string, done bool) {
+	d.running = d.running[:len(d.running)-1]
+	if done {
+		d.done[key] = struct{}{}
+	}
+}
+
+type clientKey struct {
+	tls       *tls.Config
+	transport *transportConfig
+	proxy     string
+	noproxy   string
 }
 
 func MuleContext(root *Collection) (*Context, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
 	obj := Context{
-		Global: value.CreateGlobal("mule"),
-		root:   root,
+		jar:     jar,
+		vars:    createMuleVars(root),
+		environ: createEnvVars(),
+		clients: make(map[clientKey]*http.Client),
+		deps: &depsTracker{
+			done: make(map[string]struct{}),
+		},
 	}
-	obj.RegisterProp("variables", createMuleVars(root))
-	obj.RegisterProp("environ", createEnvVars())
+	if root.verbose != nil {
+		obj.verbose = &logger{
+			w:       root.verbose,
+			secrets: root.secrets,
+		}
+	}
+	return obj.Enclosed(root)
+}
+
+// Enclosed creates a new context for the given collection that shares the
+// state of the current run (cookies, variables and environment variables set
+// by scripts) with its parent
+func (c *Context) Enclosed(root *Collection) (*Context, error) {
+	obj := Context{
+		Global:  value.CreateGlobal("mule"),
+		root:    root,
+		jar:     c.jar,
+		vars:    c.vars.enclosed(root),
+		environ: c.environ,
+		clients: c.clients,
+		deps:    c.deps,
+		verbose: c.verbose,
+		har:     c.har,
+		dry:     c.dry,
+	}
+	obj.RegisterProp("variables", obj.vars)
+	obj.RegisterProp("environ", obj.environ)
 
 	return &obj, nil
 }
 
+// getClient gives the client to use for the given configuration. Clients are
+// shared by all the requests of a run in order to reuse their connections.
+func (c *Context) getClient(key clientKey) (*http.Client, error) {
+	if client, ok := c.clients[key]; ok {
+		return client, nil
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = key.tls
+	if key.transport != nil {
+		key.transport.Configure(tr)
+	}
+	if key.proxy != "" {
+		proxy, err := createProxy(key.proxy, key.noproxy)
+		if err != nil {
+			return nil, err
+		}
+		tr.Proxy = proxy
+	}
+	client := &http.Client{
+		Jar:       c.jar,
+		Transport: tr,
+	}
+	c.clients[key] = client
+	return client, nil
+}
+
+// createProxy gives a function to be used by a transport to send requests
+// through the given proxy except for the hosts listed in noproxy. noproxy
+// follows the same rules as the NO_PROXY environment variable: an entry given
+// with a port only excludes the requests sent to this port.
+func createProxy(proxy, noproxy string) (func(*http.Request) (*url.URL, error), error) {
+	uri, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	type exclude struct {
+		host string
+		port string
+	}
+	var excludes []exclude
+	for _, e := range strings.Split(noproxy, ",") {
+		if e = strings.ToLower(strings.TrimSpace(e)); e == "" {
+			continue
+		}
+		x := exclude{
+			host: e,
+		}
+		if h, p, err := net.SplitHostPort(e); err == nil {
+			x.host, x.port = h, p
+		}
+		excludes = append(excludes, x)
+	}
+	fn := func(req *http.Request) (*url.URL, error) {
+		host, port := strings.ToLower(req.URL.Hostname()), req.URL.Port()
+		if port == "" && req.URL.Scheme == "https" {
+			port = "443"
+		} else if port == "" {
+			port = "80"
+		}
+		for _, e := range excludes {
+			if e.port != "" && e.port != port {
+				continue
+			}
+			if e.host == "*" || e.host == host || strings.HasSuffix(host, "."+strings.TrimPrefix(e.host, ".")) {
+				return nil, nil
+			}
+		}
+		return uri, nil
+	}
+	return fn, nil
+}
+
 // func (c *Context) Execute(req Request) (*http.Response, error) {
 // 	return nil, nil
 // }
@@ -64,53 +224,210 @@ func (c *Context) Call(fn string, args []value.Value) (value.Value, error) {
 }
 
 type responseValue struct {
-	res *http.Response
-}
-
-func createResponseValue(res *http.Response) value.Value {
-	return responseValue{
-		res: res,
+	res     *http.Response
+	body    []byte
+	data    any
+	decoded bool
+	timing  *timing
+}
+
+func createResponseValue(res *http.Response, body []byte, timing *timing) value.Value {
+	return &responseValue{
+		res:    res,
+		body:   body,
+		timing: timing,
 	}
 }
 
-func (_ responseValue) True() bool {
+func (_ *responseValue) True() bool {
 	return true
 }
 
-func (_ responseValue) Type() string {
+func (_ *responseValue) Type() string {
 	return "object"
 }
 
-func (_ responseValue) String() string {
+func (_ *responseValue) String() string {
 	return "<response>"
 }
 
-func (r responseValue) Get(prop string) (value.Value, error) {
+func (r *responseValue) Get(prop string) (value.Value, error) {
 	switch prop {
 	case "headers":
-		list := make(map[string]value.Value)
-		for k, v := range r.res.Header {
-			list[k] = value.CreateString(v[0])
-		}
-		return value.CreateObject(list), nil
+		return createHeadersValue(r.res.Header, true), nil
 	case "status":
 		return value.CreateString(r.res.Status), nil
 	case "code":
 		return value.CreateFloat(float64(r.res.StatusCode)), nil
 	case "contentLength":
 		return value.CreateFloat(float64(r.res.ContentLength)), nil
+	case "body":
+		return value.CreateString(string(r.body)), nil
+	case "data":
+		data, err := r.parse()
+		if err != nil {
+			return nil, err
+		}
+		return nativeToValue(data), nil
+	case "timing":
+		list := make(map[string]value.Value)
+		for k, v := range r.timing.Durations() {
+			list[k] = value.CreateFloat(v)
+		}
+		return value.CreateObject(list), nil
 	default:
 		return value.Undefined(), nil
 	}
 }
 
+func (r *responseValue) Call(fn string, args []value.Value) (value.Value, error) {
+	switch fn {
+	case "json":
+		data, err := r.decode()
+		if err != nil {
+			return nil, err
+		}
+		return nativeToValue(data), nil
+	case "jsonPath":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("jsonPath: path is missing")
+		}
+		data, err := r.decode()
+		if err != nil {
+			return nil, err
+		}
+		data, err = walkPath(data, args[0].String())
+		if err != nil {
+			return nil, err
+		}
+		return nativeToValue(data), nil
+	default:
+		return nil, value.ErrOperation
+	}
+}
+
+// decode decodes the body as JSON only once. The result is kept even when
+// the body is null.
+func (r *responseValue) decode() (any, error) {
+	if r.decoded {
+		return r.data, nil
+	}
+	if err := json.Unmarshal(r.body, &r.data); err != nil {
+		return nil, fmt.Errorf("json: invalid response body: %s", err)
+	}
+	r.decoded = true
+	return r.data, nil
+}
+
+// parse decodes the body according to the Content-Type of the response. JSON
+// and form encoded bodies are decoded, the body is given as is otherwise.
+func (r *responseValue) parse() (any, error) {
+	ctype := r.res.Header.Get("Content-Type")
+	media, _, err := mime.ParseMediaType(ctype)
+	if err != nil && ctype != "" {
+		return nil, fmt.Errorf("%s: invalid content type: %s", ctype, err)
+	}
+	switch {
+	case media == "application/json" || strings.HasSuffix(media, "+json"):
+		data, err := r.decode()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", media, err)
+		}
+		return data, nil
+	case media == "application/x-www-form-urlencoded":
+		vs, err := url.ParseQuery(string(r.body))
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid response body: %s", media, err)
+		}
+		list := make(map[string]any)
+		for k := range vs {
+			if len(vs[k]) == 1 {
+				list[k] = vs[k][0]
+				continue
+			}
+			var arr []any
+			for _, v := range vs[k] {
+				arr = append(arr, v)
+			}
+			list[k] = arr
+		}
+		return list, nil
+	default:
+		return string(r.body), nil
+	}
+}
+
+func walkPath(data any, path string) (any, error) {
+	for _, part := range strings.Split(path, ".") {
+		key, rest, _ := strings.Cut(part, "[")
+		if key != "" {
+			obj, ok := data.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%s: not an object", key)
+			}
+			if data, ok = obj[key]; !ok {
+				return nil, fmt.Errorf("%s: field not found", key)
+			}
+		}
+		for rest != "" {
+			ix, tail, ok := strings.Cut(rest, "]")
+			if !ok {
+				return nil, fmt.Errorf("%s: invalid path", path)
+			}
+			n, err := strconv.Atoi(ix)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid index", ix)
+			}
+			arr, ok := data.([]any)
+			if !ok {
+				return nil, fmt.Errorf("%s: not an array", part)
+			}
+			if n < 0 || n >= len(arr) {
+				return nil, fmt.Errorf("%d: index out of range", n)
+			}
+			data = arr[n]
+			rest = strings.TrimPrefix(tail, "[")
+		}
+	}
+	return data, nil
+}
+
+func nativeToValue(data any) value.Value {
+	switch v := data.(type) {
+	case map[string]any:
+		list := make(map[string]value.Value)
+		for k := range v {
+			list[k] = nativeToValue(v[k])
+		}
+		return value.CreateObject(list)
+	case []any:
+		var arr []value.Value
+		for i := range v {
+			arr = append(arr, nativeToValue(v[i]))
+		}
+		return value.CreateArray(arr)
+	case string:
+		return value.CreateString(v)
+	case float64:
+		return value.CreateFloat(v)
+	case bool:
+		return value.CreateBool(v)
+	default:
+		return value.Null()
+	}
+}
+
+var errImmutable = errors.New("immutable")
+
 type headersValue struct {
-	req *http.Request
+	headers   http.Header
+	immutable bool
 }
 
-func createHeadersValue(req *http.Request) value.Value {
+func createHeadersValue(hdr http.Header, immutable bool) value.Value {
 	return headersValue{
-		req: req,
+		headers:   hdr,
+		immutable: immutable,
 	}
 }
 
@@ -127,36 +444,119 @@ func (_ headersValue) String() string {
 }
 
 func (h headersValue) Get(prop string) (value.Value, error) {
-	values := h.req.Header.Values(prop)
+	values := h.headers.Values(prop)
 	if len(values) == 1 {
 		return value.CreateString(values[0]), nil
 	}
-	var arr []value.Value
-	for i := range values {
-		arr = append(arr, value.CreateString(values[i]))
-	}
-	return value.CreateArray(arr), nil
+	return h.getAll(prop), nil
 }
 
 func (h headersValue) Set(prop string, val value.Value) error {
+	if h.immutable {
+		return fmt.Errorf("%s: %w", prop, errImmutable)
+	}
 	switch v := val.(type) {
 	case *value.Array:
 		// for i := range v {
 		// 	h.req.Header.Add(prop, v[i].String())
 		// }
 	default:
-		h.req.Header.Add(prop, v.String())
+		h.headers.Add(prop, v.String())
 	}
 	return nil
 }
 
+func (h headersValue) Call(fn string, args []value.Value) (value.Value, error) {
+	switch fn {
+	case "get":
+		if len(args) == 0 {
+			return value.Undefined(), nil
+		}
+		return value.CreateString(h.headers.Get(args[0].String())), nil
+	case "getAll":
+		if len(args) == 0 {
+			return value.CreateArray(nil), nil
+		}
+		return h.getAll(args[0].String()), nil
+	case "has":
+		if len(args) == 0 {
+			return value.CreateBool(false), nil
+		}
+		_, ok := h.headers[http.CanonicalHeaderKey(args[0].String())]
+		return value.CreateBool(ok), nil
+	case "names":
+		var list []value.Value
+		for _, k := range h.names() {
+			list = append(list, value.CreateString(k))
+		}
+		return value.CreateArray(list), nil
+	case "entries":
+		var list []value.Value
+		for _, k := range h.names() {
+			for _, v := range h.headers[k] {
+				pair := []value.Value{
+					value.CreateString(k),
+					value.CreateString(v),
+				}
+				list = append(list, value.CreateArray(pair))
+			}
+		}
+		return value.CreateArray(list), nil
+	case "set", "add", "delete":
+		if h.immutable {
+			return nil, fmt.Errorf("headers: %w", errImmutable)
+		}
+		if len(args) == 0 {
+			return value.Undefined(), nil
+		}
+		key := args[0].String()
+		switch {
+		case fn == "delete":
+			h.headers.Del(key)
+		case len(args) < 2:
+		case fn == "set":
+			h.headers.Set(key, args[1].String())
+		default:
+			h.headers.Add(key, args[1].String())
+		}
+		return value.Undefined(), nil
+	default:
+		return nil, value.ErrOperation
+	}
+}
+
+func (h headersValue) names() []string {
+	list := make([]string, 0, len(h.headers))
+	for k := range h.headers {
+		list = append(list, k)
+	}
+	slices.Sort(list)
+	return list
+}
+
+func (h headersValue) getAll(prop string) value.Value {
+	var (
+		values = h.headers.Values(prop)
+		arr    []value.Value
+	)
+	for i := range values {
+		arr = append(arr, value.CreateString(values[i]))
+	}
+	return value.CreateArray(arr)
+}
+
 type requestValue struct {
-	req *http.Request
+	req       *http.Request
+	immutable bool
 }
 
-func createRequestValue(req *http.Request) value.Value {
+// createRequestValue gives access to the request to the scripts. Changes made
+// by the scripts are applied directly to req. Once the request is sent, it
+// should be created with immutable set to reject any further change.
+func createRequestValue(req *http.Request, immutable bool) value.Value {
 	return requestValue{
-		req: req,
+		req:       req,
+		immutable: immutable,
 	}
 }
 
@@ -180,13 +580,55 @@ func (r requestValue) Get(prop string) (value.Value, error) {
 		s := r.req.URL.String()
 		return value.CreateString(s), nil
 	case "headers":
-		return createHeadersValue(r.req), nil
+		return createHeadersValue(r.req.Header, r.immutable), nil
+	case "body":
+		body, err := r.content()
+		if err != nil {
+			return nil, err
+		}
+		if !utf8.Valid(body) {
+			return value.CreateString(base64.StdEncoding.EncodeToString(body)), nil
+		}
+		return value.CreateString(string(body)), nil
 	default:
 		return value.Undefined(), nil
 	}
 }
 
+func (r requestValue) Call(fn string, args []value.Value) (value.Value, error) {
+	switch fn {
+	case "json":
+		body, err := r.content()
+		if err != nil {
+			return nil, err
+		}
+		var data any
+		if err := json.Unmarshal(body, &data); err != nil {
+			return nil, fmt.Errorf("json: invalid request body: %s", err)
+		}
+		return nativeToValue(data), nil
+	default:
+		return nil, value.ErrOperation
+	}
+}
+
+// content gives the body of the request without consuming it.
+func (r requestValue) content() ([]byte, error) {
+	if r.req.GetBody == nil {
+		return nil, nil
+	}
+	rc, err := r.req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
 func (r requestValue) Set(prop string, val value.Value) error {
+	if r.immutable {
+		return errImmutable
+	}
 	switch prop {
 	case "url":
 		u, err := url.Parse(val.String())
@@ -194,21 +636,42 @@ func (r requestValue) Set(prop string, val value.Value) error {
 			return err
 		}
 		r.req.URL = u
+		r.req.Host = u.Host
+	case "method":
+		method := strings.ToUpper(strings.TrimSpace(val.String()))
+		if method == "" || strings.ContainsAny(method, " \t") {
+			return fmt.Errorf("%s: invalid method", val.String())
+		}
+		r.req.Method = method
 	case "body":
 		if r.req.Body != nil {
 			r.req.Body.Close()
 		}
-		tmp := strings.NewReader(val.String())
-		r.req.Body = io.NopCloser(tmp)
+		body := []byte(val.String())
+		r.req.Body = io.NopCloser(bytes.NewReader(body))
+		r.req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		r.req.ContentLength = int64(len(body))
+		if len(body) == 0 {
+			r.req.Body = http.NoBody
+			r.req.GetBody = func() (io.ReadCloser, error) {
+				return http.NoBody, nil
+			}
+		}
 	default:
 	}
 	return nil
 }
 
-type envVars struct{}
+type envVars struct {
+	values map[string]string
+}
 
-func createEnvVars() value.Value {
-	return envVars{}
+func createEnvVars() envVars {
+	return envVars{
+		values: make(map[string]string),
+	}
 }
 
 func (_ envVars) True() bool {
@@ -224,50 +687,111 @@ func (_ envVars) String() string {
 }
 
 func (v envVars) Get(prop string) (value.Value, error) {
-	n := strings.ToUpper(prop)
-	s := os.Getenv(n)
+	s, _ := v.lookup(prop)
 	return value.CreateString(s), nil
 }
 
 func (v envVars) Call(fn string, args []value.Value) (value.Value, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s: variable name is missing", fn)
+	}
 	switch fn {
 	case "get":
 		return v.Get(args[0].String())
+	case "has":
+		_, ok := v.lookup(args[0].String())
+		return value.CreateBool(ok), nil
+	case "set":
+		if len(args) < 2 {
+			return nil, fmt.Errorf("%s: value is missing", args[0])
+		}
+		v.values[strings.ToUpper(args[0].String())] = args[1].String()
+		return value.Undefined(), nil
 	default:
 		return nil, value.ErrOperation
 	}
 }
 
+// lookup checks first the variables set by scripts before looking into the
+// environment of the process. The process environment is never modified.
+func (v envVars) lookup(name string) (string, bool) {
+	name = strings.ToUpper(name)
+	if s, ok := v.values[name]; ok {
+		return s, ok
+	}
+	return os.LookupEnv(name)
+}
+
 type muleVars struct {
+	values  map[string]string
 	context env.Environ[string]
 }
 
-func createMuleVars(ev env.Environ[string]) value.Value {
-	return muleVars{
+func createMuleVars(ev env.Environ[string]) *muleVars {
+	return &muleVars{
+		values:  make(map[string]string),
+		context: ev,
+	}
+}
+
+func (v *muleVars) enclosed(ev env.Environ[string]) *muleVars {
+	return &muleVars{
+		values:  v.values,
 		context: ev,
 	}
 }
 
-func (_ muleVars) True() bool {
+func (_ *muleVars) True() bool {
 	return true
 }
 
-func (_ muleVars) Type() string {
+func (_ *muleVars) Type() string {
 	return "object"
 }
 
-func (_ muleVars) String() string {
+func (_ *muleVars) String() string {
 	return "<variables>"
 }
 
-func (v muleVars) Call(fn string, args []value.Value) (value.Value, error) {
+func (v *muleVars) Resolve(key string) (string, error) {
+	if str, ok := v.values[key]; ok {
+		return str, nil
+	}
+	return v.context.Resolve(key)
+}
+
+func (v *muleVars) Define(key, value string, _ bool) error {
+	v.values[key] = value
+	return nil
+}
+
+func (v *muleVars) Assign(key, value string) error {
+	return v.Define(key, value, false)
+}
+
+func (v *muleVars) Call(fn string, args []value.Value) (value.Value, error) {
+	if fn != "clear" && len(args) == 0 {
+		return nil, fmt.Errorf("%s: variable name is missing", fn)
+	}
 	switch fn {
 	case "set":
-		err := v.context.Assign(args[0].String(), args[1].String())
+		if len(args) < 2 {
+			return nil, fmt.Errorf("%s: value is missing", args[0])
+		}
+		err := v.Define(args[0].String(), args[1].String(), false)
 		return value.Undefined(), err
 	case "get":
-		s, err := v.context.Resolve(args[0].String())
+		s, err := v.Resolve(args[0].String())
 		return value.CreateString(s), err
+	case "has":
+		_, err := v.Resolve(args[0].String())
+		return value.CreateBool(err == nil), nil
+	case "unset":
+		delete(v.values, args[0].String())
+		return value.Undefined(), nil
+	case "clear":
+		clear(v.values)
+		return value.Undefined(), nil
 	default:
 		return nil, value.ErrOperation
 	}
@@ -279,4 +803,4 @@ func muleEnv(ctx *Context) env.Environ[value.Value] {
 	sub.Define("mule", ctx, true)
 
 	return env.EnclosedEnv[value.Value](env.Immutable(sub))
-}
\ No newline at end of file
+}
@@ -0,0 +1,864 @@
+package mule
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/midbel/enjoy/env"
+	"github.com/midbel/enjoy/value"
+)
+
+// scriptFunc is used in place of a compiled script to check what the scripts
+// can do with the context and the variables given to them.
+type scriptFunc func(*Context, env.Environ[value.Value]) error
+
+func (fn scriptFunc) Eval(ev env.Environ[value.Value]) (value.Value, error) {
+	v, err := ev.Resolve("mule")
+	if err != nil {
+		return nil, err
+	}
+	ctx, ok := v.(*Context)
+	if !ok {
+		return nil, fmt.Errorf("mule: unexpected value %s", v.Type())
+	}
+	return value.Undefined(), fn(ctx, ev)
+}
+
+// constScript is used in place of a compiled condition that always gives the
+// same result.
+type constScript bool
+
+func (c constScript) Eval(_ env.Environ[value.Value]) (value.Value, error) {
+	return c, nil
+}
+
+func (c constScript) True() bool {
+	return bool(c)
+}
+
+func (_ constScript) Type() string {
+	return "boolean"
+}
+
+func (c constScript) String() string {
+	return strconv.FormatBool(bool(c))
+}
+
+// findRequest gives the request with the given name in order to attach it
+// scripts after parsing the collection.
+func findRequest(t *testing.T, c *Collection, name string) *Request {
+	t.Helper()
+	for i := range c.requests {
+		if c.requests[i].Name == name {
+			return &c.requests[i]
+		}
+	}
+	t.Fatalf("%s: request not defined", name)
+	return nil
+}
+
+func TestHeadersNames(t *testing.T) {
+	h := headersValue{
+		headers: http.Header{
+			"X-Request-Id":  []string{"1"},
+			"Accept":        []string{"text/plain", "application/json"},
+			"Content-Type":  []string{"application/json"},
+			"Authorization": []string{"Bearer token"},
+		},
+	}
+	want := []string{"Accept", "Authorization", "Content-Type", "X-Request-Id"}
+	for i := 0; i < 10; i++ {
+		if got := h.names(); !slices.Equal(got, want) {
+			t.Fatalf("names mismatched! want %s, got %s", want, got)
+		}
+	}
+}
+
+func TestHeadersImmutable(t *testing.T) {
+	h := headersValue{
+		headers:   http.Header{},
+		immutable: true,
+	}
+	if err := h.Set("accept", value.CreateString("text/plain")); !errors.Is(err, errImmutable) {
+		t.Errorf("set: immutable error expected, got %v", err)
+	}
+	for _, fn := range []string{"set", "add", "delete"} {
+		args := []value.Value{
+			value.CreateString("accept"),
+			value.CreateString("text/plain"),
+		}
+		if _, err := h.Call(fn, args); !errors.Is(err, errImmutable) {
+			t.Errorf("%s: immutable error expected, got %v", fn, err)
+		}
+	}
+	if len(h.headers) != 0 {
+		t.Errorf("headers should not have been modified")
+	}
+}
+
+func TestWalkPath(t *testing.T) {
+	const doc = `{
+		"name": "mule",
+		"version": 1,
+		"tags": ["http", "client"],
+		"owner": {"name": "midbel", "repos": [{"name": "enjoy"}, {"name": "mule"}]},
+		"matrix": [[1, 2], [3, 4]]
+	}`
+	var data any
+	if err := json.Unmarshal([]byte(doc), &data); err != nil {
+		t.Fatalf("invalid test document: %s", err)
+	}
+	tests := []struct {
+		Path string
+		Want any
+		Fail bool
+	}{
+		{Path: "name", Want: "mule"},
+		{Path: "version", Want: 1.0},
+		{Path: "tags[1]", Want: "client"},
+		{Path: "owner.name", Want: "midbel"},
+		{Path: "owner.repos[0].name", Want: "enjoy"},
+		{Path: "matrix[1][0]", Want: 3.0},
+		{Path: "tags", Want: []any{"http", "client"}},
+		{Path: "missing", Fail: true},
+		{Path: "name.first", Fail: true},
+		{Path: "tags[2]", Fail: true},
+		{Path: "tags[-1]", Fail: true},
+		{Path: "tags[first]", Fail: true},
+		{Path: "tags[0", Fail: true},
+		{Path: "owner[0]", Fail: true},
+	}
+	for _, tt := range tests {
+		got, err := walkPath(data, tt.Path)
+		if tt.Fail {
+			if err == nil {
+				t.Errorf("%s: expected error but got %v", tt.Path, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.Path, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.Want) {
+			t.Errorf("%s: value mismatched! want %v, got %v", tt.Path, tt.Want, got)
+		}
+	}
+}
+
+func TestMuleVariables(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secret")
+	})
+	mux.HandleFunc("/profile", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "token missing", http.StatusUnauthorized)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	src := `
+url %q
+post login {
+	url '/login'
+	expect 200
+}
+get profile {
+	depends login
+	url '/profile'
+	expect 200
+	headers {
+		authorization "Bearer ${token}"
+	}
+}
+`
+	c, err := parseString(fmt.Sprintf(src, srv.URL))
+	if err != nil {
+		t.Fatalf("unexpected error parsing collection: %s", err)
+	}
+	call := func(ctx *Context, fn string, args ...string) (value.Value, error) {
+		var list []value.Value
+		for _, a := range args {
+			list = append(list, value.CreateString(a))
+		}
+		return ctx.vars.Call(fn, list)
+	}
+	findRequest(t, c, "login").after = scriptFunc(func(ctx *Context, ev env.Environ[value.Value]) error {
+		body, err := ev.Resolve(resBody)
+		if err != nil {
+			return err
+		}
+		if _, err := call(ctx, "set", "token", body.String()); err != nil {
+			return err
+		}
+		_, err = call(ctx, "set", "scratch", "foobar")
+		return err
+	})
+	var checked bool
+	findRequest(t, c, "profile").after = scriptFunc(func(ctx *Context, _ env.Environ[value.Value]) error {
+		checked = true
+		if v, err := call(ctx, "get", "token"); err != nil || v.String() != "secret" {
+			t.Errorf("get: token mismatched! want secret, got %v (%v)", v, err)
+		}
+		if v, err := call(ctx, "has", "token"); err != nil || !v.True() {
+			t.Errorf("has: token should be defined")
+		}
+		if _, err := call(ctx, "unset", "scratch"); err != nil {
+			return err
+		}
+		if _, err := ctx.vars.Resolve("scratch"); err == nil {
+			t.Errorf("unset: scratch should have been removed")
+		}
+		if _, err := call(ctx, "clear"); err != nil {
+			return err
+		}
+		if _, err := ctx.vars.Resolve("token"); err == nil {
+			t.Errorf("clear: token should have been removed")
+		}
+		return nil
+	})
+	if err := c.Run("profile", io.Discard); err != nil {
+		t.Fatalf("variable not visible to the next request: %s", err)
+	}
+	if !checked {
+		t.Errorf("after script of profile not executed")
+	}
+}
+
+func TestEnvironVariables(t *testing.T) {
+	const name = "MULE_TEST_TOKEN"
+	t.Setenv(name, "process")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	src := `
+url %q
+get first {
+	url '/first'
+}
+get second {
+	depends first
+	url '/second'
+}
+`
+	c, err := parseString(fmt.Sprintf(src, srv.URL))
+	if err != nil {
+		t.Fatalf("unexpected error parsing collection: %s", err)
+	}
+	findRequest(t, c, "first").after = scriptFunc(func(ctx *Context, _ env.Environ[value.Value]) error {
+		args := []value.Value{
+			value.CreateString(name),
+			value.CreateString("script"),
+		}
+		_, err := ctx.environ.Call("set", args)
+		return err
+	})
+	var got string
+	findRequest(t, c, "second").after = scriptFunc(func(ctx *Context, _ env.Environ[value.Value]) error {
+		v, err := ctx.environ.Call("get", []value.Value{value.CreateString(name)})
+		if err == nil {
+			got = v.String()
+		}
+		return err
+	})
+	if err := c.Run("second", io.Discard); err != nil {
+		t.Fatalf("unexpected error running request: %s", err)
+	}
+	if got != "script" {
+		t.Errorf("%s: value mismatched! want script, got %s", name, got)
+	}
+	if v := os.Getenv(name); v != "process" {
+		t.Errorf("%s: process environment modified! want process, got %s", name, v)
+	}
+}
+
+func TestGetClient(t *testing.T) {
+	ctx, err := MuleContext(Empty(""))
+	if err != nil {
+		t.Fatalf("unexpected error creating context: %s", err)
+	}
+	var (
+		cfg = transportConfig{
+			maxIdle:     10,
+			idleTimeout: time.Second,
+		}
+		other = transportConfig{
+			noHttp2: true,
+		}
+		keys = []clientKey{
+			{},
+			{transport: &cfg},
+			{transport: &other},
+			{transport: &cfg, proxy: "http://localhost:3128"},
+		}
+		clients []*http.Client
+	)
+	for _, k := range keys {
+		client, err := ctx.getClient(k)
+		if err != nil {
+			t.Fatalf("unexpected error creating client: %s", err)
+		}
+		if again, _ := ctx.getClient(k); again != client {
+			t.Errorf("client not reused for the same configuration")
+		}
+		if slices.Contains(clients, client) {
+			t.Errorf("client reused for a different configuration")
+		}
+		clients = append(clients, client)
+	}
+	tr := clients[1].Transport.(*http.Transport)
+	if tr.MaxIdleConns != cfg.maxIdle || tr.IdleConnTimeout != cfg.idleTimeout {
+		t.Errorf("transport not configured")
+	}
+	if !tr.ForceAttemptHTTP2 || tr.TLSNextProto != nil {
+		t.Errorf("http2 should be enabled by default")
+	}
+	tr = clients[2].Transport.(*http.Transport)
+	if tr.ForceAttemptHTTP2 || tr.TLSNextProto == nil || len(tr.TLSNextProto) != 0 {
+		t.Errorf("http2 should be disabled")
+	}
+}
+
+func TestTransportConnections(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		conns int
+	)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			defer mu.Unlock()
+			conns++
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	tests := []struct {
+		Transport string
+		Want      int
+	}{
+		{Transport: "keepAlive true", Want: 1},
+		{Transport: "keepAlive false", Want: 3},
+	}
+	for _, tt := range tests {
+		src := `
+url %q
+transport {
+	%s
+}
+get first {
+	url '/first'
+}
+get second {
+	depends first
+	url '/second'
+}
+collection sub {
+	get third {
+		url '/third'
+	}
+}
+`
+		c, err := parseString(fmt.Sprintf(src, srv.URL, tt.Transport))
+		if err != nil {
+			t.Fatalf("unexpected error parsing collection: %s", err)
+		}
+		findRequest(t, c, "second").after = scriptFunc(func(ctx *Context, _ env.Environ[value.Value]) error {
+			sub, err := ctx.root.GetCollection("sub")
+			if err != nil {
+				return err
+			}
+			q, err := sub.GetRequest("third")
+			if err != nil {
+				return err
+			}
+			return sub.execute(ctx, q, io.Discard)
+		})
+		mu.Lock()
+		conns = 0
+		mu.Unlock()
+		if err := c.Run("second", io.Discard); err != nil {
+			t.Fatalf("%s: unexpected error running request: %s", tt.Transport, err)
+		}
+		mu.Lock()
+		if conns != tt.Want {
+			t.Errorf("%s: connections mismatched! want %d, got %d", tt.Transport, tt.Want, conns)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestTransportHTTP2(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	tests := []struct {
+		HTTP2 string
+		Want  string
+	}{
+		{HTTP2: "true", Want: "HTTP/2.0"},
+		{HTTP2: "false", Want: "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		src := "tls {\n\tinsecure true\n}\ntransport {\n\thttp2 %s\n}\nget test {\n\turl %q\n}\n"
+		c, err := parseString(fmt.Sprintf(src, tt.HTTP2, srv.URL))
+		if err != nil {
+			t.Fatalf("unexpected error parsing collection: %s", err)
+		}
+		var out strings.Builder
+		if err := c.Run("test", &out); err != nil {
+			t.Errorf("http2 %s: unexpected error running request: %s", tt.HTTP2, err)
+			continue
+		}
+		if out.String() != tt.Want {
+			t.Errorf("http2 %s: protocol mismatched! want %s, got %s", tt.HTTP2, tt.Want, out.String())
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	tests := []struct {
+		Timeout string
+		Fail    bool
+	}{
+		{Timeout: "'50ms'", Fail: true},
+		{Timeout: "5"},
+		{Timeout: "'1h'"},
+	}
+	for _, tt := range tests {
+		src := fmt.Sprintf("get test {\n\turl %q\n\ttimeout %s\n}\n", srv.URL, tt.Timeout)
+		c, err := parseString(src)
+		if err != nil {
+			t.Fatalf("unexpected error parsing collection: %s", err)
+		}
+		if !tt.Fail {
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				done <- struct{}{}
+			}()
+		}
+		err = c.Run("test", io.Discard)
+		if tt.Fail && !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: timeout expected, got %v", tt.Timeout, err)
+		}
+		if !tt.Fail && err != nil {
+			t.Errorf("%s: unexpected error running request: %s", tt.Timeout, err)
+		}
+	}
+}
+
+func TestCreateProxy(t *testing.T) {
+	tests := []struct {
+		NoProxy string
+		URL     string
+		Proxied bool
+	}{
+		{NoProxy: "", URL: "http://example.com", Proxied: true},
+		{NoProxy: "*", URL: "http://example.com"},
+		{NoProxy: "example.com", URL: "http://example.com"},
+		{NoProxy: "example.com", URL: "http://api.example.com"},
+		{NoProxy: ".example.com", URL: "http://api.example.com"},
+		{NoProxy: "example.com", URL: "http://myexample.com", Proxied: true},
+		{NoProxy: "localhost, .internal", URL: "http://db.internal:5432"},
+		{NoProxy: "localhost, .internal", URL: "http://LOCALHOST"},
+		{NoProxy: "example.com:8080", URL: "http://example.com:8080"},
+		{NoProxy: "example.com:8080", URL: "http://example.com", Proxied: true},
+		{NoProxy: "example.com:443", URL: "https://api.example.com"},
+		{NoProxy: "example.com:443", URL: "http://example.com", Proxied: true},
+		{NoProxy: "[::1]:8080", URL: "http://[::1]:8080"},
+		{NoProxy: "::1", URL: "http://[::1]:8080"},
+		{NoProxy: "127.0.0.1", URL: "http://127.0.0.2", Proxied: true},
+	}
+	for _, tt := range tests {
+		proxy, err := createProxy("http://proxy:3128", tt.NoProxy)
+		if err != nil {
+			t.Fatalf("unexpected error creating proxy: %s", err)
+		}
+		req, err := http.NewRequest(http.MethodGet, tt.URL, nil)
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %s", err)
+		}
+		uri, err := proxy(req)
+		if err != nil {
+			t.Errorf("%s (%s): unexpected error: %s", tt.URL, tt.NoProxy, err)
+			continue
+		}
+		if got := uri != nil; got != tt.Proxied {
+			t.Errorf("%s (%s): proxy mismatched! want %t, got %t", tt.URL, tt.NoProxy, tt.Proxied, got)
+		}
+	}
+}
+
+func TestRequestProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "proxy "+r.URL.String())
+	}))
+	defer proxy.Close()
+	direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "direct")
+	}))
+	defer direct.Close()
+
+	t.Setenv("MULE_TEST_PROXY", proxy.URL)
+	port := direct.Listener.Addr().(*net.TCPAddr).Port
+	tests := []struct {
+		Proxy string
+		URL   string
+		Want  string
+	}{
+		{
+			Proxy: fmt.Sprintf("proxy %q", proxy.URL),
+			URL:   "http://api.example.com/users",
+			Want:  "proxy http://api.example.com/users",
+		},
+		{
+			Proxy: "proxy @env MULE_TEST_PROXY",
+			URL:   "http://api.example.com/users",
+			Want:  "proxy http://api.example.com/users",
+		},
+		{
+			Proxy: "proxy @env MULE_TEST_PROXY\nnoproxy '.example.org'",
+			URL:   "http://api.example.com/users",
+			Want:  "proxy http://api.example.com/users",
+		},
+		{
+			Proxy: "proxy @env MULE_TEST_PROXY\nnoproxy '.example.com' '127.0.0.1'",
+			URL:   direct.URL,
+			Want:  "direct",
+		},
+		{
+			Proxy: fmt.Sprintf("proxy @env MULE_TEST_PROXY\nnoproxy '127.0.0.1:%d'", port),
+			URL:   direct.URL,
+			Want:  "direct",
+		},
+		{
+			Proxy: fmt.Sprintf("proxy @env MULE_TEST_PROXY\nnoproxy '127.0.0.1:%d'", port+1),
+			URL:   direct.URL,
+			Want:  "proxy " + direct.URL + "/",
+		},
+	}
+	for _, tt := range tests {
+		c, err := parseString(fmt.Sprintf("%s\nget test {\n\turl %q\n}\n", tt.Proxy, tt.URL))
+		if err != nil {
+			t.Fatalf("unexpected error parsing collection: %s", err)
+		}
+		var out strings.Builder
+		if err := c.Run("test", &out); err != nil {
+			t.Errorf("%s: unexpected error running request: %s", tt.Proxy, err)
+			continue
+		}
+		if out.String() != tt.Want {
+			t.Errorf("%s: response mismatched! want %s, got %s", tt.Proxy, tt.Want, out.String())
+		}
+	}
+}
+
+func TestResponseParse(t *testing.T) {
+	tests := []struct {
+		Type string
+		Body string
+		Want any
+		Fail bool
+	}{
+		{
+			Type: "application/json",
+			Body: `{"name": "mule", "tags": ["http"], "version": 1}`,
+			Want: map[string]any{"name": "mule", "tags": []any{"http"}, "version": 1.0},
+		},
+		{
+			Type: "application/problem+json; charset=utf-8",
+			Body: `{"status": 404}`,
+			Want: map[string]any{"status": 404.0},
+		},
+		{
+			Type: "application/json",
+			Body: `{"name": }`,
+			Fail: true,
+		},
+		{
+			Type: "application/x-www-form-urlencoded",
+			Body: "name=mule&tags=http&tags=client&empty=",
+			Want: map[string]any{"name": "mule", "tags": []any{"http", "client"}, "empty": ""},
+		},
+		{
+			Type: "application/x-www-form-urlencoded",
+			Body: "name=%zz",
+			Fail: true,
+		},
+		{
+			Type: "text/plain",
+			Body: "name=mule",
+			Want: "name=mule",
+		},
+		{
+			Body: `{"name": "mule"}`,
+			Want: `{"name": "mule"}`,
+		},
+		{
+			Type: "application/json; charset",
+			Body: `{}`,
+			Fail: true,
+		},
+	}
+	for _, tt := range tests {
+		res := responseValue{
+			res: &http.Response{
+				Header: http.Header{},
+			},
+			body: []byte(tt.Body),
+		}
+		if tt.Type != "" {
+			res.res.Header.Set("Content-Type", tt.Type)
+		}
+		got, err := res.parse()
+		if tt.Fail {
+			if err == nil {
+				t.Errorf("%s: expected error but got %v", tt.Body, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.Body, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.Want) {
+			t.Errorf("%s: data mismatched! want %v, got %v", tt.Body, tt.Want, got)
+		}
+	}
+}
+
+func TestResponseDecode(t *testing.T) {
+	tests := []struct {
+		Body string
+		Want any
+	}{
+		{Body: "null", Want: nil},
+		{Body: "false", Want: false},
+		{Body: `{"name": "mule"}`, Want: map[string]any{"name": "mule"}},
+	}
+	for _, tt := range tests {
+		res := responseValue{
+			body: []byte(tt.Body),
+		}
+		got, err := res.decode()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.Body, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.Want) {
+			t.Errorf("%s: data mismatched! want %v, got %v", tt.Body, tt.Want, got)
+		}
+		res.body = []byte("invalid")
+		if got, err = res.decode(); err != nil || !reflect.DeepEqual(got, tt.Want) {
+			t.Errorf("%s: body decoded twice! got %v (%v)", tt.Body, got, err)
+		}
+	}
+}
+
+func TestDepsTracker(t *testing.T) {
+	deps := depsTracker{
+		done: make(map[string]struct{}),
+	}
+	enter := func(key string, want bool) {
+		t.Helper()
+		ok, err := deps.Enter(key)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", key, err)
+		}
+		if ok != want {
+			t.Fatalf("%s: enter mismatched! want %t, got %t", key, want, ok)
+		}
+	}
+	enter("login", true)
+	deps.Leave("login", false)
+	enter("login", true)
+	deps.Leave("login", true)
+	enter("login", false)
+
+	enter("orders", true)
+	enter("users.profile", true)
+	_, err := deps.Enter("orders")
+	if want := "dependency cycle detected: orders -> users.profile -> orders"; err == nil || err.Error() != want {
+		t.Fatalf("cycle error mismatched! want %s, got %v", want, err)
+	}
+	deps.Leave("users.profile", true)
+	deps.Leave("orders", true)
+	if len(deps.running) != 0 {
+		t.Errorf("running requests should be empty! got %s", deps.running)
+	}
+	enter("users.profile", false)
+	enter("orders", false)
+}
+
+func TestRequestValueImmutable(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, "http://localhost/users", strings.NewReader("mule"))
+	if err != nil {
+		t.Fatalf("unexpected error creating request: %s", err)
+	}
+	r := createRequestValue(req, true).(requestValue)
+	for _, prop := range []string{"url", "method", "body"} {
+		if err := r.Set(prop, value.CreateString("http://localhost/other")); !errors.Is(err, errImmutable) {
+			t.Errorf("%s: immutable error expected, got %v", prop, err)
+		}
+	}
+	hdr, err := r.Get("headers")
+	if err != nil {
+		t.Fatalf("unexpected error getting headers: %s", err)
+	}
+	if err := hdr.(headersValue).Set("accept", value.CreateString("text/plain")); !errors.Is(err, errImmutable) {
+		t.Errorf("headers: immutable error expected, got %v", err)
+	}
+	if req.URL.String() != "http://localhost/users" || req.Method != http.MethodPost || len(req.Header) != 0 {
+		t.Errorf("request should not have been modified")
+	}
+}
+
+func TestRequestValueSet(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request sent to the url set before the script")
+	})
+	mux.HandleFunc("/new", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/final", http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("/final", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %d %s", r.Method, r.ContentLength, body)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		Method string
+		Body   string
+		Want   string
+	}{
+		{Method: "put", Body: `{"name": "mule"}`, Want: `PUT 16 {"name": "mule"}`},
+		{Method: " patch ", Body: "", Want: "PATCH 0 "},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/old", strings.NewReader("old body"))
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %s", err)
+		}
+		r := createRequestValue(req, false).(requestValue)
+		if err := r.Set("url", value.CreateString(srv.URL+"/new")); err != nil {
+			t.Fatalf("url: unexpected error: %s", err)
+		}
+		if err := r.Set("method", value.CreateString(tt.Method)); err != nil {
+			t.Fatalf("method: unexpected error: %s", err)
+		}
+		if err := r.Set("body", value.CreateString(tt.Body)); err != nil {
+			t.Fatalf("body: unexpected error: %s", err)
+		}
+		if req.ContentLength != int64(len(tt.Body)) {
+			t.Errorf("%s: content length mismatched! want %d, got %d", tt.Method, len(tt.Body), req.ContentLength)
+		}
+		rc, err := req.GetBody()
+		if err != nil {
+			t.Fatalf("%s: unexpected error getting body: %s", tt.Method, err)
+		}
+		if body, _ := io.ReadAll(rc); string(body) != tt.Body {
+			t.Errorf("%s: body mismatched! want %s, got %s", tt.Method, tt.Body, body)
+		}
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s: unexpected error sending request: %s", tt.Method, err)
+		}
+		got, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if string(got) != tt.Want {
+			t.Errorf("%s: request mismatched! want %s, got %s", tt.Method, tt.Want, got)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating request: %s", err)
+	}
+	r := createRequestValue(req, false).(requestValue)
+	for _, m := range []string{"", "get post"} {
+		if err := r.Set("method", value.CreateString(m)); err == nil {
+			t.Errorf("%q: expected error for invalid method", m)
+		}
+	}
+	if err := r.Set("url", value.CreateString("http://[::1")); err == nil {
+		t.Errorf("expected error for invalid url")
+	}
+}
+
+func TestRequestValueBody(t *testing.T) {
+	binary := []byte{0xff, 0xd8, 0xff, 0xe0, 0x00}
+	tests := []struct {
+		Body []byte
+		Want string
+	}{
+		{Body: nil, Want: ""},
+		{Body: []byte(`{"name": "mule"}`), Want: `{"name": "mule"}`},
+		{Body: []byte("héllo"), Want: "héllo"},
+		{Body: binary, Want: base64.StdEncoding.EncodeToString(binary)},
+	}
+	for _, tt := range tests {
+		var body io.Reader
+		if tt.Body != nil {
+			body = bytes.NewReader(tt.Body)
+		}
+		req, err := http.NewRequest(http.MethodPost, "http://localhost/upload", body)
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %s", err)
+		}
+		r := createRequestValue(req, false).(requestValue)
+		for i := 0; i < 2; i++ {
+			got, err := r.Get("body")
+			if err != nil {
+				t.Errorf("%q: unexpected error getting body: %s", tt.Body, err)
+				break
+			}
+			if got.String() != tt.Want {
+				t.Errorf("%q: body mismatched! want %s, got %s", tt.Body, tt.Want, got)
+			}
+		}
+		if tt.Body == nil {
+			continue
+		}
+		sent, err := io.ReadAll(req.Body)
+		if err != nil || !bytes.Equal(sent, tt.Body) {
+			t.Errorf("%q: body consumed by the script! got %q", tt.Body, sent)
+		}
+	}
+}
@@ -0,0 +1,421 @@
+package mule
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/midbel/enjoy/value"
+)
+
+// Format writes the collection back as mule source. Collections included with
+// @include, variables loaded with @datafile and files read with @readfile are
+// written inline.
+func (c *Collection) Format(w io.Writer) error {
+	f := formatter{
+		writer: bufio.NewWriter(w),
+	}
+	if c.Name == "" {
+		f.formatBody(c)
+	} else {
+		f.formatCollection(c)
+	}
+	if f.err != nil {
+		return f.err
+	}
+	return f.writer.Flush()
+}
+
+type formatter struct {
+	writer *bufio.Writer
+	level  int
+	err    error
+}
+
+func (f *formatter) formatCollection(c *Collection) {
+	f.startBlock("collection " + c.Name)
+	f.formatBody(c)
+	f.endBlock()
+}
+
+func (f *formatter) formatBody(c *Collection) {
+	f.formatVariables(c)
+	for _, e := range c.profiles {
+		f.startBlock("environment " + e.Name)
+		f.formatVariables(e)
+		f.endBlock()
+	}
+	f.formatTLS(c.config)
+	if c.transport != nil {
+		f.formatTransport(c.transport)
+	}
+	if c.rate != nil {
+		f.writeLine("rate", f.literal(c.rate.interval.String()))
+	}
+	f.formatWord("proxy", c.proxy)
+	f.formatWords("noproxy", c.noproxy)
+	f.formatWord("url", c.base)
+	f.formatWord("username", c.user)
+	f.formatWord("password", c.pass)
+	f.formatBag("headers", c.headers)
+	f.formatBag("default headers", c.defaults)
+	f.formatBag("force headers", c.forced)
+	f.formatBag("query", c.query)
+	for _, b := range c.cookies {
+		f.formatBag("cookie", b)
+	}
+	for _, e := range c.before {
+		f.formatScript("before", e)
+	}
+	for _, e := range c.after {
+		f.formatScript("after", e)
+	}
+	for _, e := range c.beforeEach {
+		f.formatScript("beforeEach", e)
+	}
+	for _, e := range c.afterEach {
+		f.formatScript("afterEach", e)
+	}
+
+	requests := slices.Clone(c.requests)
+	sort.SliceStable(requests, func(i, j int) bool {
+		if requests[i].Order == requests[j].Order {
+			return requests[i].Name < requests[j].Name
+		}
+		return requests[i].Order < requests[j].Order
+	})
+	for _, r := range requests {
+		f.formatRequest(r)
+	}
+
+	collections := slices.Clone(c.collections)
+	sort.Slice(collections, func(i, j int) bool {
+		return collections[i].Name < collections[j].Name
+	})
+	for _, c := range collections {
+		f.formatCollection(c)
+	}
+}
+
+func (f *formatter) formatVariables(c *Collection) {
+	if len(c.names) == 0 {
+		return
+	}
+	f.startBlock("variables")
+	names := slices.Clone(c.names)
+	sort.Strings(names)
+	for _, n := range names {
+		v, err := c.env.Resolve(n)
+		if err != nil {
+			continue
+		}
+		name := n
+		if !isBare(name) {
+			name = f.text(name)
+		}
+		if strings.ContainsRune(v, squote) {
+			f.writeLine(name, f.heredoc(v))
+			continue
+		}
+		f.writeLine(name, f.literal(v))
+	}
+	f.endBlock()
+}
+
+func (f *formatter) formatRequest(r Request) {
+	kw, err := methodKeyword(r.method)
+	if err != nil {
+		f.fail(err)
+		return
+	}
+	f.startBlock(kw + " " + r.Name)
+	f.formatWords("depends", r.depends)
+	if r.assert != nil {
+		f.formatScript("expect", r.assert)
+	} else {
+		f.formatWord("expect", r.expected)
+	}
+	if r.schema != nil {
+		f.writeLine("expect", "schema", f.literal(r.schema.source))
+	}
+	f.formatWord("url", r.location)
+	f.formatWord("username", r.user)
+	f.formatWord("password", r.pass)
+	f.formatWord("retry", r.retry)
+	f.formatWord("timeout", r.timeout)
+	f.formatWord("stream", r.stream)
+	f.formatWord("output", r.output)
+	f.formatWord("proxy", r.proxy)
+	f.formatWords("noproxy", r.noproxy)
+	f.formatTLS(r.config)
+	f.formatBag("headers", r.headers)
+	f.formatBag("query", r.query)
+	for _, b := range r.cookies {
+		f.formatBag("cookie", b)
+	}
+	if r.body != nil {
+		f.formatRequestBody(r.body)
+	}
+	f.formatScript("when", r.when)
+	f.formatScript("skipIf", r.skip)
+	f.formatScript("before", r.before)
+	f.formatScript("after", r.after)
+	f.endBlock()
+}
+
+func (f *formatter) formatRequestBody(b Body) {
+	switch b := b.(type) {
+	case stringBody:
+		f.writeLine("body", f.literal(string(b)))
+	case graphqlBody:
+		f.startBlock("body graphql")
+		f.formatWord("query", b.query)
+		f.formatWord("operation", b.operation)
+		f.formatBag("variables", b.variables)
+		f.endBlock()
+	default:
+		f.fail(fmt.Errorf("%T: body can not be formatted", b))
+	}
+}
+
+func (f *formatter) formatTransport(cfg *transportConfig) {
+	f.startBlock("transport")
+	if cfg.maxIdle > 0 {
+		f.writeLine("maxIdleConns", strconv.Itoa(cfg.maxIdle))
+	}
+	if cfg.maxIdlePerHost > 0 {
+		f.writeLine("maxIdleConnsPerHost", strconv.Itoa(cfg.maxIdlePerHost))
+	}
+	if cfg.maxConnPerHost > 0 {
+		f.writeLine("maxConnsPerHost", strconv.Itoa(cfg.maxConnPerHost))
+	}
+	if cfg.idleTimeout > 0 {
+		f.writeLine("idleTimeout", f.literal(cfg.idleTimeout.String()))
+	}
+	f.writeLine("keepAlive", strconv.FormatBool(!cfg.noKeepAlive))
+	f.writeLine("http2", strconv.FormatBool(!cfg.noHttp2))
+	f.endBlock()
+}
+
+func (f *formatter) formatTLS(cfg *tlsConfig) {
+	if cfg == nil {
+		return
+	}
+	f.startBlock("tls")
+	for _, o := range cfg.options {
+		list := make([]string, 0, len(o.List))
+		for _, w := range o.List {
+			list = append(list, f.word(w))
+		}
+		f.writeLine(o.Key, list...)
+	}
+	f.endBlock()
+}
+
+func (f *formatter) formatScript(kw string, e value.Evaluable) {
+	if e == nil {
+		return
+	}
+	s, ok := e.(script)
+	if !ok {
+		f.fail(fmt.Errorf("%s: script can not be formatted", kw))
+		return
+	}
+	f.writeLine(kw, f.text(s.source))
+}
+
+func (f *formatter) formatBag(kw string, b Bag) {
+	if b == nil {
+		return
+	}
+	list := b.pairs()
+	if len(list) == 0 {
+		return
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key < list[j].Key
+	})
+	if _, ok := b.(frozenBag); ok {
+		kw += " *"
+	}
+	f.startBlock(kw)
+	for _, p := range list {
+		f.formatWords(p.Key, p.List)
+	}
+	f.endBlock()
+}
+
+func (f *formatter) formatWord(kw string, w Word) {
+	if w == nil {
+		return
+	}
+	f.writeLine(kw, f.word(w))
+}
+
+func (f *formatter) formatWords(kw string, ws []Word) {
+	if len(ws) == 0 {
+		return
+	}
+	list := make([]string, 0, len(ws))
+	for _, w := range ws {
+		list = append(list, f.word(w))
+	}
+	f.writeLine(kw, list...)
+}
+
+func (f *formatter) word(w Word) string {
+	switch w := w.(type) {
+	case literal:
+		return f.literal(string(w))
+	case variable:
+		return "${" + string(w) + "}"
+	case expansion:
+		return "${" + w.source + "}"
+	case environ:
+		return "@env " + string(w)
+	case uuid:
+		return "@uuid"
+	case timestamp:
+		if w.format == nil {
+			return "@timestamp"
+		}
+		return "@timestamp " + f.quote(f.word(w.format))
+	case encoded:
+		return "@" + w.macro + " " + f.word(w.Word)
+	case compound:
+		return f.compound(w)
+	case mergedURL:
+		return f.word(w.child)
+	default:
+		f.fail(fmt.Errorf("%T: word can not be formatted", w))
+		return ""
+	}
+}
+
+func (f *formatter) compound(ws compound) string {
+	var str strings.Builder
+	str.WriteByte(dquote)
+	for _, w := range ws {
+		switch w := w.(type) {
+		case literal:
+			if strings.ContainsAny(string(w), "\"$") {
+				f.fail(fmt.Errorf("%s: literal can not be written between double quotes", w))
+			}
+			str.WriteString(string(w))
+		case variable, expansion:
+			str.WriteString(f.word(w))
+		default:
+			f.fail(fmt.Errorf("%T: word can not be written between double quotes", w))
+		}
+	}
+	str.WriteByte(dquote)
+	return str.String()
+}
+
+// quote makes sure that the formatted word is scanned as a single token when
+// used as argument of a macro.
+func (f *formatter) quote(str string) string {
+	if strings.HasPrefix(str, "'") || strings.HasPrefix(str, "\"") {
+		return str
+	}
+	return "'" + str + "'"
+}
+
+func (f *formatter) literal(str string) string {
+	if isBare(str) {
+		return str
+	}
+	return f.text(str)
+}
+
+// text writes str between quotes or in a heredoc even if it could be written
+// as is.
+func (f *formatter) text(str string) string {
+	if !strings.ContainsRune(str, squote) {
+		return "'" + str + "'"
+	}
+	if !strings.ContainsAny(str, "\"$") {
+		return "\"" + str + "\""
+	}
+	return f.heredoc(str)
+}
+
+// heredoc writes str in a heredoc indented one level deeper than the current
+// line. The scanner removes the leading blanks of each line of a heredoc.
+func (f *formatter) heredoc(str string) string {
+	delim := "EOF"
+	for strings.Contains(str, delim) {
+		delim += "F"
+	}
+	var (
+		buf    strings.Builder
+		indent = strings.Repeat("\t", f.level)
+	)
+	buf.WriteString("<<" + delim)
+	for _, line := range strings.Split(str, "\n") {
+		buf.WriteString("\n" + indent + "\t" + line)
+	}
+	buf.WriteString("\n" + indent + delim)
+	return buf.String()
+}
+
+func (f *formatter) startBlock(kw string) {
+	f.writeLine(kw, "{")
+	f.level++
+}
+
+func (f *formatter) endBlock() {
+	f.level--
+	f.writeLine("}")
+}
+
+func (f *formatter) writeLine(kw string, args ...string) {
+	if f.err != nil {
+		return
+	}
+	f.writer.WriteString(strings.Repeat("\t", f.level))
+	f.writer.WriteString(kw)
+	for _, a := range args {
+		f.writer.WriteByte(' ')
+		f.writer.WriteString(a)
+	}
+	f.writer.WriteByte(nl)
+}
+
+func (f *formatter) fail(err error) {
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+func methodKeyword(method string) (string, error) {
+	method = strings.ToUpper(method)
+	for kw, m := range methods {
+		if m == method {
+			return kw, nil
+		}
+	}
+	return "", fmt.Errorf("%s: method can not be written", method)
+}
+
+func isBare(str string) bool {
+	if str == "" || isSpecial(str) {
+		return false
+	}
+	if strings.Trim(str, "0123456789") == "" {
+		return true
+	}
+	for i, r := range str {
+		if i == 0 && !isLetter(r) {
+			return false
+		}
+		if !isAlpha(r) && r != '-' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package mule
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatSyntax(t *testing.T) {
+	syntax, err := os.ReadFile(filepath.Join("data", "syntax.mu"))
+	if err != nil {
+		t.Fatalf("unexpected error reading syntax file: %s", err)
+	}
+	dir := t.TempDir()
+	writeCertificate(t, dir)
+
+	files := map[string]string{
+		"syntax.mu":          string(syntax),
+		"secrets.env":        "token=secret\nexport user='mule'\n",
+		"config.json":        `{"db": {"host": "localhost", "port": 5432}}`,
+		"body.json":          `{"name": "it's mule"}`,
+		"query.graphql":      "query search($limit: Int) {\n\tusers(limit: $limit) { name }\n}\n",
+		"signature.bin":      "signature",
+		"search.schema.json": `{"type": "object", "required": ["users"]}`,
+	}
+	for file, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0o644); err != nil {
+			t.Fatalf("unexpected error writing %s: %s", file, err)
+		}
+	}
+	// the files given in tls blocks are relative to the working directory
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("unexpected error getting working directory: %s", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("unexpected error changing working directory: %s", err)
+	}
+	defer os.Chdir(cwd)
+
+	r, err := os.Open(filepath.Join(dir, "syntax.mu"))
+	if err != nil {
+		t.Fatalf("unexpected error opening syntax file: %s", err)
+	}
+	defer r.Close()
+
+	c, err := NewParser(r).Parse()
+	if err != nil {
+		t.Fatalf("unexpected error parsing syntax file: %s", err)
+	}
+	var first bytes.Buffer
+	if err := c.Format(&first); err != nil {
+		t.Fatalf("unexpected error formatting collection: %s", err)
+	}
+	other, err := parseString(first.String())
+	if err != nil {
+		t.Fatalf("unexpected error parsing formatted collection: %s\n%s", err, first.String())
+	}
+	var second bytes.Buffer
+	if err := other.Format(&second); err != nil {
+		t.Fatalf("unexpected error formatting parsed collection: %s", err)
+	}
+	if first.String() != second.String() {
+		t.Fatalf("formatted collections mismatched!\nwant:\n%s\ngot:\n%s", first.String(), second.String())
+	}
+
+	want := []string{
+		"certFile 'client.pem'",
+		"certCA 'ca.pem'",
+		"\t\t\tcertCA\n",
+		"minVersion 'tls-1.2'",
+		"token secret",
+		"'db.port' 5432",
+		"x-signature @base64 signature",
+		"x-request-date @timestamp '2006-01-02'",
+		"get request {",
+		"expect 'if (mule.response.code != 200) {\nthrow \"unexpected status code\"\n}'",
+		"\"name\": \"it's mule\"",
+		"expect schema",
+	}
+	for _, str := range want {
+		if !strings.Contains(first.String(), str) {
+			t.Errorf("%q not found in formatted collection:\n%s", str, first.String())
+		}
+	}
+}
+
+func writeCertificate(t *testing.T, dir string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error generating key: %s", err)
+	}
+	tpl := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"mule"}},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, &tpl, &tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error creating certificate: %s", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error encoding key: %s", err)
+	}
+	blocks := map[string]*pem.Block{
+		"client.pem": {Type: "CERTIFICATE", Bytes: cert},
+		"ca.pem":     {Type: "CERTIFICATE", Bytes: cert},
+		"client.key": {Type: "EC PRIVATE KEY", Bytes: der},
+	}
+	for file, block := range blocks {
+		if err := os.WriteFile(filepath.Join(dir, file), pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatalf("unexpected error writing %s: %s", file, err)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package mule
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+	"unicode/utf8"
+)
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harTimings struct {
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harEntry struct {
+	Started  time.Time   `json:"startedDateTime"`
+	Time     float64     `json:"time"`
+	Request  harRequest  `json:"request"`
+	Response harResponse `json:"response"`
+	Cache    struct{}    `json:"cache"`
+	Timings  harTimings  `json:"timings"`
+}
+
+// harRecorder keeps the requests sent and the responses received during a run
+// in order to write them as an HTTP archive (HAR 1.2).
+type harRecorder struct {
+	entries []harEntry
+}
+
+// Record adds an entry for the given request and its response. cookies are the
+// cookies of the jar sent with the request in addition to its own cookies.
+func (h *harRecorder) Record(req *http.Request, body []byte, cookies []*http.Cookie, res *http.Response, content []byte, t *timing) {
+	var (
+		ds    = t.Durations()
+		entry harEntry
+	)
+	entry.Started = t.start
+	entry.Time = ds["total"]
+	entry.Timings = harTimings{
+		DNS:     ds["dns"],
+		Connect: ds["connect"],
+		SSL:     ds["tls"],
+		Wait:    ds["firstByte"] - ds["dns"] - ds["connect"] - ds["tls"],
+		Receive: ds["total"] - ds["firstByte"],
+	}
+	if entry.Timings.Wait < 0 {
+		entry.Timings.Wait = 0
+	}
+	entry.Request = harRequest{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: req.Proto,
+		Headers:     harHeaders(req.Header),
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+	for k, vs := range req.URL.Query() {
+		for _, v := range vs {
+			entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: k, Value: v})
+		}
+	}
+	list := req.Cookies()
+	for _, c := range cookies {
+		seen := slices.ContainsFunc(list, func(other *http.Cookie) bool {
+			return other.Name == c.Name
+		})
+		if !seen {
+			list = append(list, c)
+		}
+	}
+	for _, c := range list {
+		entry.Request.Cookies = append(entry.Request.Cookies, harNameValue{Name: c.Name, Value: c.Value})
+	}
+	if len(body) > 0 {
+		entry.Request.PostData = &harPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     string(body),
+		}
+	}
+	entry.Response = harResponse{
+		Status:      res.StatusCode,
+		StatusText:  http.StatusText(res.StatusCode),
+		HTTPVersion: res.Proto,
+		Headers:     harHeaders(res.Header),
+		RedirectURL: res.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    len(content),
+		Content: harContent{
+			Size:     len(content),
+			MimeType: res.Header.Get("Content-Type"),
+			Text:     string(content),
+		},
+	}
+	if !utf8.Valid(content) {
+		entry.Response.Content.Text = base64.StdEncoding.EncodeToString(content)
+		entry.Response.Content.Encoding = "base64"
+	}
+	for _, c := range res.Cookies() {
+		entry.Response.Cookies = append(entry.Response.Cookies, harNameValue{Name: c.Name, Value: c.Value})
+	}
+	h.entries = append(h.entries, entry)
+}
+
+func (h *harRecorder) Encode(w io.Writer) error {
+	var doc struct {
+		Log struct {
+			Version string `json:"version"`
+			Creator struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"creator"`
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	doc.Log.Version = "1.2"
+	doc.Log.Creator.Name = "mule"
+	doc.Log.Creator.Version = "0.0.0"
+	doc.Log.Entries = h.entries
+	if doc.Log.Entries == nil {
+		doc.Log.Entries = []harEntry{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+func harHeaders(hdr http.Header) []harNameValue {
+	list := []harNameValue{}
+	for k, vs := range hdr {
+		for _, v := range vs {
+			list = append(list, harNameValue{Name: k, Value: v})
+		}
+	}
+	return list
+}
@@ -0,0 +1,97 @@
+package mule
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecordHAR(t *testing.T) {
+	binary := []byte{0xff, 0xfe, 0x00, 0x01}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "foobar", Path: "/"})
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "welcome")
+	})
+	mux.HandleFunc("/avatar", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(binary)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	src := `
+url %q
+post login {
+	url '/login'
+	body '{"user": "mule"}'
+}
+get avatar {
+	depends login
+	url '/avatar'
+	query {
+		size 64
+	}
+}
+`
+	c, err := parseString(fmt.Sprintf(src, srv.URL))
+	if err != nil {
+		t.Fatalf("unexpected error parsing collection: %s", err)
+	}
+	var har bytes.Buffer
+	if err := c.Record("avatar", io.Discard, &har); err != nil {
+		t.Fatalf("unexpected error running request: %s", err)
+	}
+	var doc struct {
+		Log struct {
+			Version string     `json:"version"`
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.Unmarshal(har.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid HAR document: %s", err)
+	}
+	if doc.Log.Version != "1.2" {
+		t.Errorf("version mismatched! want 1.2, got %s", doc.Log.Version)
+	}
+	if len(doc.Log.Entries) != 2 {
+		t.Fatalf("entries mismatched! want 2, got %d", len(doc.Log.Entries))
+	}
+	login, avatar := doc.Log.Entries[0], doc.Log.Entries[1]
+	if login.Request.Method != http.MethodPost || login.Response.Status != http.StatusCreated {
+		t.Errorf("login: entry mismatched! got %s %d", login.Request.Method, login.Response.Status)
+	}
+	if login.Request.PostData == nil || login.Request.PostData.Text != `{"user": "mule"}` {
+		t.Errorf("login: post data mismatched")
+	}
+	if login.Response.Content.Text != "welcome" || login.Response.Content.Encoding != "" {
+		t.Errorf("login: content mismatched! got %s", login.Response.Content.Text)
+	}
+	if len(login.Response.Cookies) != 1 || login.Response.Cookies[0].Name != "session" {
+		t.Errorf("login: response cookies mismatched! got %v", login.Response.Cookies)
+	}
+	if avatar.Request.Method != http.MethodGet || avatar.Response.Status != http.StatusOK {
+		t.Errorf("avatar: entry mismatched! got %s %d", avatar.Request.Method, avatar.Response.Status)
+	}
+	if len(avatar.Request.QueryString) != 1 || avatar.Request.QueryString[0].Value != "64" {
+		t.Errorf("avatar: query string mismatched! got %v", avatar.Request.QueryString)
+	}
+	want := []harNameValue{{Name: "session", Value: "foobar"}}
+	if got := avatar.Request.Cookies; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("avatar: request cookies mismatched! want %v, got %v", want, got)
+	}
+	content := avatar.Response.Content
+	if content.Encoding != "base64" || content.Text != base64.StdEncoding.EncodeToString(binary) {
+		t.Errorf("avatar: content mismatched! got %s (%s)", content.Text, content.Encoding)
+	}
+	if content.Size != len(binary) {
+		t.Errorf("avatar: content size mismatched! want %d, got %d", len(binary), content.Size)
+	}
+}
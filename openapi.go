@@ -0,0 +1,321 @@
+package mule
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type openapiSpec struct {
+	Info struct {
+		Title   string `json:"title"`
+		Version string `json:"version"`
+	} `json:"info"`
+	Servers []struct {
+		URL string `json:"url"`
+	} `json:"servers"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]*openapiSchema `json:"schemas"`
+	} `json:"components"`
+}
+
+type openapiOperation struct {
+	OperationID string             `json:"operationId"`
+	Summary     string             `json:"summary"`
+	Description string             `json:"description"`
+	Tags        []string           `json:"tags"`
+	Parameters  []openapiParameter `json:"parameters"`
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema  *openapiSchema `json:"schema"`
+			Example any            `json:"example"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+type openapiParameter struct {
+	Name     string         `json:"name"`
+	In       string         `json:"in"`
+	Required bool           `json:"required"`
+	Example  any            `json:"example"`
+	Schema   *openapiSchema `json:"schema"`
+}
+
+type openapiSchema struct {
+	Ref        string                    `json:"$ref"`
+	Type       string                    `json:"type"`
+	Default    any                       `json:"default"`
+	Example    any                       `json:"example"`
+	Enum       []any                     `json:"enum"`
+	Items      *openapiSchema            `json:"items"`
+	Properties map[string]*openapiSchema `json:"properties"`
+}
+
+var openapiMethods = []string{
+	http.MethodGet,
+	http.MethodPut,
+	http.MethodPost,
+	http.MethodDelete,
+	http.MethodOptions,
+	http.MethodHead,
+	http.MethodPatch,
+	http.MethodTrace,
+}
+
+// ImportOpenAPI creates a collection from an OpenAPI 3 specification (JSON
+// only). Each operation becomes a request put in the collection of its first
+// tag. Path, query and header parameters are turned into variables defined in
+// that collection with the default value given by the specification.
+func ImportOpenAPI(r io.Reader) (*Collection, error) {
+	var spec openapiSpec
+	if err := json.NewDecoder(r).Decode(&spec); err != nil {
+		return nil, err
+	}
+	root := Empty(openapiIdent(spec.Info.Title, "openapi"))
+	root.Version = spec.Info.Version
+
+	if len(spec.Servers) > 0 && spec.Servers[0].URL != "" {
+		root.base = createLiteral(strings.TrimSuffix(spec.Servers[0].URL, "/"))
+	}
+	tags := make(map[string]*Collection)
+
+	paths := make([]string, 0, len(spec.Paths))
+	for p := range spec.Paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		item := spec.Paths[path]
+		var common []openapiParameter
+		if raw, ok := item["parameters"]; ok {
+			if err := json.Unmarshal(raw, &common); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+		for _, method := range openapiMethods {
+			raw, ok := item[strings.ToLower(method)]
+			if !ok {
+				continue
+			}
+			var op openapiOperation
+			if err := json.Unmarshal(raw, &op); err != nil {
+				return nil, fmt.Errorf("%s %s: %w", method, path, err)
+			}
+			collect := root
+			if len(op.Tags) > 0 {
+				name := openapiIdent(op.Tags[0], "tag")
+				if tags[name] == nil {
+					tags[name] = Enclosed(name, root)
+					root.AddCollection(tags[name])
+				}
+				collect = tags[name]
+			}
+			req, err := spec.createRequest(collect, method, path, op, common)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", method, path, err)
+			}
+			req.Order = len(collect.requests)
+			collect.AddRequest(req)
+		}
+	}
+	return root, nil
+}
+
+func (s openapiSpec) createRequest(collect *Collection, method, path string, op openapiOperation, common []openapiParameter) (Request, error) {
+	name := op.OperationID
+	if name == "" {
+		name = strings.ToLower(method) + "_" + path
+	}
+	req := Prepare(openapiIdent(name, "request"), method)
+	req.Usage = op.Summary
+	req.Help = op.Description
+
+	location, err := openapiPath(path)
+	if err != nil {
+		return req, err
+	}
+	req.location = location
+
+	params := make(map[string]openapiParameter)
+	for _, p := range append(common, op.Parameters...) {
+		params[p.In+"/"+p.Name] = p
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p := params[k]
+		if _, err := collect.env.Resolve(p.Name); err != nil {
+			collect.Define(p.Name, openapiDefault(p), false)
+		}
+		switch p.In {
+		case "query":
+			req.query.Add(p.Name, createVariable(p.Name))
+		case "header":
+			req.headers.Add(p.Name, createVariable(p.Name))
+		case "cookie":
+			cookie := Standard()
+			cookie.Set("name", createLiteral(p.Name))
+			cookie.Set("value", createVariable(p.Name))
+			req.cookies = append(req.cookies, cookie)
+		}
+	}
+	if op.RequestBody == nil || len(op.RequestBody.Content) == 0 {
+		return req, nil
+	}
+	mimes := make([]string, 0, len(op.RequestBody.Content))
+	for m := range op.RequestBody.Content {
+		mimes = append(mimes, m)
+	}
+	sort.Strings(mimes)
+	mime := mimes[0]
+	for _, m := range mimes {
+		if strings.Contains(m, "json") {
+			mime = m
+			break
+		}
+	}
+	media := op.RequestBody.Content[mime]
+	sample := media.Example
+	if sample == nil {
+		sample = s.sample(media.Schema, 0)
+	}
+	if sample == nil {
+		return req, nil
+	}
+	buf, err := json.MarshalIndent(sample, "", "  ")
+	if err != nil {
+		return req, err
+	}
+	req.body = stringBody(buf)
+	req.headers.Set("Content-Type", createLiteral(mime))
+	return req, nil
+}
+
+// sample builds a value matching the schema to be used as skeleton for the
+// body of a request.
+func (s openapiSpec) sample(schema *openapiSchema, depth int) any {
+	if schema == nil || depth > 8 {
+		return nil
+	}
+	if schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+		return s.sample(s.Components.Schemas[name], depth+1)
+	}
+	switch {
+	case schema.Example != nil:
+		return schema.Example
+	case schema.Default != nil:
+		return schema.Default
+	case len(schema.Enum) > 0:
+		return schema.Enum[0]
+	}
+	switch schema.Type {
+	case "object", "":
+		if schema.Type == "" && len(schema.Properties) == 0 {
+			return nil
+		}
+		obj := make(map[string]any)
+		for k, p := range schema.Properties {
+			obj[k] = s.sample(p, depth+1)
+		}
+		return obj
+	case "array":
+		arr := []any{}
+		if v := s.sample(schema.Items, depth+1); v != nil {
+			arr = append(arr, v)
+		}
+		return arr
+	case "string":
+		return ""
+	case "integer", "number":
+		return 0
+	case "boolean":
+		return false
+	default:
+		return nil
+	}
+}
+
+func openapiPath(path string) (Word, error) {
+	var (
+		ws   compound
+		rest = path
+	)
+	for {
+		before, after, ok := strings.Cut(rest, "{")
+		if !ok {
+			break
+		}
+		name, tail, ok := strings.Cut(after, "}")
+		if !ok {
+			return nil, fmt.Errorf("%s: unterminated path parameter", path)
+		}
+		if before != "" {
+			ws = append(ws, createLiteral(before))
+		}
+		ws = append(ws, createVariable(name))
+		rest = tail
+	}
+	if rest != "" {
+		ws = append(ws, createLiteral(rest))
+	}
+	if len(ws) == 1 {
+		return ws[0], nil
+	}
+	return ws, nil
+}
+
+func openapiDefault(p openapiParameter) string {
+	val := p.Example
+	if val == nil && p.Schema != nil {
+		switch {
+		case p.Schema.Default != nil:
+			val = p.Schema.Default
+		case p.Schema.Example != nil:
+			val = p.Schema.Example
+		case len(p.Schema.Enum) > 0:
+			val = p.Schema.Enum[0]
+		}
+	}
+	if val == nil {
+		return ""
+	}
+	return fmt.Sprint(val)
+}
+
+// openapiIdent transforms str into an identifier accepted by the parser. The
+// characters other than ASCII letters and digits are replaced by underscores
+// and prefix is added in front of the identifiers that do not start with a
+// letter or that are keywords.
+func openapiIdent(str, prefix string) string {
+	var (
+		buf   strings.Builder
+		under bool
+	)
+	for _, r := range strings.TrimSpace(str) {
+		if isLetter(r) || isDigit(r) {
+			buf.WriteRune(r)
+			under = false
+			continue
+		}
+		if !under && buf.Len() > 0 {
+			buf.WriteRune('_')
+			under = true
+		}
+	}
+	ident := strings.TrimRight(buf.String(), "_")
+	if ident == "" {
+		return prefix
+	}
+	if !isLetter(rune(ident[0])) || isSpecial(ident) {
+		ident = prefix + "_" + ident
+	}
+	return ident
+}
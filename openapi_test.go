@@ -0,0 +1,168 @@
+package mule
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const petstore = `{
+	"openapi": "3.0.3",
+	"info": {"title": "Swagger Petstore", "version": "1.0.0"},
+	"servers": [{"url": "/api/v3"}],
+	"paths": {
+		"/pet": {
+			"put": {
+				"operationId": "updatePet",
+				"tags": ["pet"],
+				"requestBody": {
+					"content": {
+						"application/json": {"schema": {"$ref": "#/components/schemas/Pet"}}
+					}
+				}
+			},
+			"options": {"operationId": "get", "tags": ["pet"]},
+			"trace": {"operationId": "123trace", "tags": ["pet"]}
+		},
+		"/pet/{petId}": {
+			"parameters": [
+				{"name": "petId", "in": "path", "required": true, "schema": {"type": "integer", "example": 10}}
+			],
+			"get": {
+				"operationId": "getPetById",
+				"summary": "Find pet by ID",
+				"tags": ["pet"],
+				"parameters": [
+					{"name": "api_key", "in": "header", "schema": {"type": "string"}},
+					{"name": "session", "in": "cookie", "schema": {"type": "string", "default": "abc"}}
+				]
+			},
+			"delete": {"operationId": "collection", "tags": ["pet"]}
+		},
+		"/store/inventory": {
+			"get": {
+				"operationId": "rate",
+				"tags": ["2fa store"],
+				"parameters": [
+					{"name": "status", "in": "query", "schema": {"type": "string", "enum": ["available", "sold"]}}
+				]
+			}
+		},
+		"/health": {
+			"head": {}
+		}
+	},
+	"components": {
+		"schemas": {
+			"Pet": {
+				"type": "object",
+				"properties": {
+					"name": {"type": "string", "example": "doggie"},
+					"tags": {"type": "array", "items": {"type": "string"}}
+				}
+			}
+		}
+	}
+}`
+
+func TestImportOpenAPI(t *testing.T) {
+	c, err := ImportOpenAPI(strings.NewReader(petstore))
+	if err != nil {
+		t.Fatalf("unexpected error importing spec: %s", err)
+	}
+	var first bytes.Buffer
+	if err := c.Format(&first); err != nil {
+		t.Fatalf("unexpected error formatting collection: %s", err)
+	}
+	other, err := parseString(first.String())
+	if err != nil {
+		t.Fatalf("unexpected error parsing formatted collection: %s\n%s", err, first.String())
+	}
+	var second bytes.Buffer
+	if err := other.Format(&second); err != nil {
+		t.Fatalf("unexpected error formatting parsed collection: %s", err)
+	}
+	if first.String() != second.String() {
+		t.Errorf("formatted collections mismatched!\nwant:\n%s\ngot:\n%s", first.String(), second.String())
+	}
+
+	tests := []struct {
+		Collection string
+		Request    string
+		Method     string
+	}{
+		{Collection: "pet", Request: "updatePet", Method: "PUT"},
+		{Collection: "pet", Request: "request_get", Method: "OPTIONS"},
+		{Collection: "pet", Request: "request_123trace", Method: "TRACE"},
+		{Collection: "pet", Request: "getPetById", Method: "GET"},
+		{Collection: "pet", Request: "request_collection", Method: "DELETE"},
+		{Collection: "tag_2fa_store", Request: "request_rate", Method: "GET"},
+		{Request: "head_health", Method: "HEAD"},
+	}
+	root, err := other.GetCollection("Swagger_Petstore")
+	if err != nil {
+		t.Fatalf("collection not found in parsed collection")
+	}
+	for _, tt := range tests {
+		collect := root
+		if tt.Collection != "" {
+			if collect, err = root.GetCollection(tt.Collection); err != nil {
+				t.Errorf("%s: collection not found", tt.Collection)
+				continue
+			}
+		}
+		req, err := collect.GetRequest(tt.Request)
+		if err != nil {
+			t.Errorf("%s: request not found in %s", tt.Request, tt.Collection)
+			continue
+		}
+		if req.method != tt.Method {
+			t.Errorf("%s: method mismatched! want %s, got %s", tt.Request, tt.Method, req.method)
+		}
+	}
+
+	pet, err := c.GetCollection("pet")
+	if err != nil {
+		t.Fatalf("pet: collection not found")
+	}
+	req, err := pet.GetRequest("getPetById")
+	if err != nil {
+		t.Fatalf("getPetById: request not found")
+	}
+	uri, err := req.location.Expand(pet)
+	if err != nil {
+		t.Fatalf("unexpected error expanding url: %s", err)
+	}
+	if want := "/api/v3/pet/10"; uri != want {
+		t.Errorf("url mismatched! want %s, got %s", want, uri)
+	}
+}
+
+func TestOpenAPIIdent(t *testing.T) {
+	tests := []struct {
+		Input string
+		Want  string
+	}{
+		{Input: "getPetById", Want: "getPetById"},
+		{Input: "find pets-by status", Want: "find_pets_by_status"},
+		{Input: "  Swagger Petstore - OpenAPI 3.0 ", Want: "Swagger_Petstore_OpenAPI_3_0"},
+		{Input: "123abc", Want: "request_123abc"},
+		{Input: "_private", Want: "private"},
+		{Input: "créer", Want: "cr_er"},
+		{Input: "get", Want: "request_get"},
+		{Input: "collection", Want: "request_collection"},
+		{Input: "", Want: "request"},
+		{Input: "!!!", Want: "request"},
+	}
+	for _, tt := range tests {
+		got := openapiIdent(tt.Input, "request")
+		if got != tt.Want {
+			t.Errorf("%q: identifier mismatched! want %s, got %s", tt.Input, tt.Want, got)
+			continue
+		}
+		s := Scan(strings.NewReader(got))
+		if tok := s.Scan(); tok.Type != Ident || tok.Literal != got {
+			t.Errorf("%q: %s not scanned as an identifier (%s)", tt.Input, got, tok)
+		}
+	}
+}
@@ -3,13 +3,16 @@ package mule
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/midbel/enjoy/env"
 	"github.com/midbel/enjoy/eval"
@@ -17,13 +20,28 @@ import (
 	"github.com/midbel/enjoy/value"
 )
 
+// tlsConfig keeps the options given in a tls block next to the configuration
+// built from them so the block can be written back.
 type tlsConfig struct {
+	options  []pair
 	certFile string
 	certKey  string
 
 	Config tls.Config
 }
 
+// methods gives the HTTP method of each keyword used to define a request.
+var methods = map[string]string{
+	"get":    http.MethodGet,
+	"post":   http.MethodPost,
+	"put":    http.MethodPut,
+	"delete": http.MethodDelete,
+	"patch":  http.MethodPatch,
+	"head":   http.MethodHead,
+	"option": http.MethodOptions,
+	"trace":  http.MethodTrace,
+}
+
 type Parser struct {
 	dispatch map[string]func(*Collection) error
 	macros   map[string]func() (interface{}, error)
@@ -43,28 +61,45 @@ func NewParser(r io.Reader) *Parser {
 		p.file = filepath.Dir(n.Name())
 	}
 	p.macros = map[string]func() (interface{}, error){
-		"include": p.parseIncludeMacro,
+		"include":      p.parseIncludeMacro,
+		"datafile":     p.parseDataFileMacro,
+		"base64":       p.parseEncodeMacro("base64", encodeBase64),
+		"base64decode": p.parseEncodeMacro("base64decode", decodeBase64),
+		"hex":          p.parseEncodeMacro("hex", encodeHex),
+		"hexdecode":    p.parseEncodeMacro("hexdecode", decodeHex),
+		"env":          p.parseEnvMacro,
+		"uuid":         p.parseUUIDMacro,
+		"timestamp":    p.parseTimestampMacro,
 	}
 	p.dispatch = map[string]func(*Collection) error{
-		"url":        p.parseCollectionURL,
-		"username":   p.parseCollectionUser,
-		"password":   p.parseCollectionPass,
-		"variables":  p.parseVariables,
-		"collection": p.parseCollection,
-		"headers":    p.parseCollectionHeaders,
-		"query":      p.parseCollectionQuery,
-		"tls":        p.parseCollectionTLS,
-		"beforeEach": p.parseCollectionScript,
-		"afterEach":  p.parseCollectionScript,
-		"before":     p.parseCollectionScript,
-		"after":      p.parseCollectionScript,
-		"get":        p.parseRequest,
-		"post":       p.parseRequest,
-		"put":        p.parseRequest,
-		"delete":     p.parseRequest,
-		"patch":      p.parseRequest,
-		"head":       p.parseRequest,
-		"option":     p.parseRequest,
+		"url":         p.parseCollectionURL,
+		"username":    p.parseCollectionUser,
+		"password":    p.parseCollectionPass,
+		"variables":   p.parseVariables,
+		"environment": p.parseEnvironment,
+		"collection":  p.parseCollection,
+		"headers":     p.parseCollectionHeaders,
+		"default":     p.parseCollectionHeadersMode,
+		"force":       p.parseCollectionHeadersMode,
+		"query":       p.parseCollectionQuery,
+		"cookie":      p.parseCollectionCookie,
+		"tls":         p.parseCollectionTLS,
+		"transport":   p.parseCollectionTransport,
+		"rate":        p.parseCollectionRate,
+		"proxy":       p.parseCollectionProxy,
+		"noproxy":     p.parseCollectionNoProxy,
+		"beforeEach":  p.parseCollectionScript,
+		"afterEach":   p.parseCollectionScript,
+		"before":      p.parseCollectionScript,
+		"after":       p.parseCollectionScript,
+		"get":         p.parseRequest,
+		"post":        p.parseRequest,
+		"put":         p.parseRequest,
+		"delete":      p.parseRequest,
+		"patch":       p.parseRequest,
+		"head":        p.parseRequest,
+		"option":      p.parseRequest,
+		"trace":       p.parseRequest,
 	}
 	p.next()
 	p.next()
@@ -132,11 +167,66 @@ func (p *Parser) parseReadFileMacro() (interface{}, error) {
 	default:
 		return nil, fmt.Errorf("%s can not be included - wrong scheme given %s", uri.Path, uri.Scheme)
 	}
+	if err != nil {
+		return nil, err
+	}
 	p.next()
-	p.skip(EOL)
 	return string(buf), nil
 }
 
+func (p *Parser) parseDataFileMacro() (interface{}, error) {
+	file := filepath.Join(p.file, p.curr.Literal)
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var vars map[string]string
+	switch filepath.Ext(file) {
+	case ".json":
+		vars, err = readJSONData(buf)
+	case ".env":
+		vars, err = readEnvData(buf)
+	default:
+		err = fmt.Errorf("%s: unsupported data file", file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.next()
+	p.skip(EOL)
+	return vars, nil
+}
+
+func (p *Parser) parseEncodeMacro(macro string, encode func(string) (string, error)) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		w, err := p.parseWord()
+		if err != nil {
+			return nil, err
+		}
+		return createEncoded(w, macro, encode), nil
+	}
+}
+
+func (p *Parser) parseEnvMacro() (interface{}, error) {
+	defer p.next()
+	return createEnv(p.curr.Literal), nil
+}
+
+func (p *Parser) parseUUIDMacro() (interface{}, error) {
+	return createUUID(), nil
+}
+
+func (p *Parser) parseTimestampMacro() (interface{}, error) {
+	if !p.is(String) && !p.is(Quote) {
+		return createTimestamp(nil), nil
+	}
+	w, err := p.parseWord()
+	if err != nil {
+		return nil, err
+	}
+	return createTimestamp(w), nil
+}
+
 func (p *Parser) parseMain() (*Collection, error) {
 	collect := Empty("")
 	for !p.done() {
@@ -155,11 +245,16 @@ func (p *Parser) startParse(collect *Collection) error {
 		if err != nil {
 			return err
 		}
-		c, ok := dat.(*Collection)
-		if !ok {
+		switch d := dat.(type) {
+		case *Collection:
+			collect.AddCollection(d)
+		case map[string]string:
+			for k, v := range d {
+				collect.Define(k, v, false)
+			}
+		default:
 			return fmt.Errorf("no collection received from macro")
 		}
-		collect.collections = append(collect.collections, c)
 		p.skip(EOL)
 		return nil
 	}
@@ -177,7 +272,7 @@ func (p *Parser) startParse(collect *Collection) error {
 
 func (p *Parser) parseCollection(parent *Collection) error {
 	p.next()
-	if !p.is(Ident) {
+	if !p.isIdent() {
 		return p.unexpected()
 	}
 	curr := Enclosed(p.curr.Literal, parent)
@@ -197,6 +292,32 @@ func (p *Parser) parseCollection(parent *Collection) error {
 	return p.expect(Rbrace)
 }
 
+func (p *Parser) parseEnvironment(parent *Collection) error {
+	p.next()
+	if !p.isIdent() {
+		return p.unexpected()
+	}
+	curr := Enclosed(p.curr.Literal, parent)
+	p.next()
+	if err := p.expect(Lbrace); err != nil {
+		return err
+	}
+	defer p.skip(EOL)
+	p.skip(EOL)
+	for !p.done() && !p.is(Rbrace) {
+		p.skip(Comment)
+		if !p.is(Keyword) || p.curr.Literal != "variables" {
+			return p.unexpected()
+		}
+		if err := p.parseVariables(curr); err != nil {
+			return err
+		}
+		p.skip(EOL)
+	}
+	parent.AddEnvironment(curr)
+	return p.expect(Rbrace)
+}
+
 func (p *Parser) parseCollectionUser(collect *Collection) error {
 	p.next()
 
@@ -222,15 +343,17 @@ func (p *Parser) parseCollectionURL(collect *Collection) error {
 
 func (p *Parser) parseRequest(collect *Collection) error {
 	p.unregisterMacroFunc("include")
+	p.unregisterMacroFunc("datafile")
 	p.registerMacroFunc("readfile", p.parseReadFileMacro)
 	defer func() {
 		p.registerMacroFunc("include", p.parseIncludeMacro)
+		p.registerMacroFunc("datafile", p.parseDataFileMacro)
 		p.unregisterMacroFunc("readfile")
 	}()
 
-	method := p.curr.Literal
+	method := methods[p.curr.Literal]
 	p.next()
-	if !p.is(Ident) {
+	if !p.isIdent() {
 		return p.unexpected()
 	}
 	var (
@@ -264,6 +387,15 @@ func (p *Parser) parseRequest(collect *Collection) error {
 			req.retry, err = p.parseWord()
 		case "timeout":
 			req.timeout, err = p.parseWord()
+		case "stream":
+			req.stream, err = p.parseWord()
+		case "output":
+			req.output, err = p.parseWord()
+			req.dir = p.file
+		case "proxy":
+			req.proxy, err = p.parseWord()
+		case "noproxy":
+			req.noproxy, err = p.parseDepends()
 		case "headers":
 			req.headers, err = p.parseBag()
 		case "query":
@@ -271,16 +403,32 @@ func (p *Parser) parseRequest(collect *Collection) error {
 		case "body":
 			req.body, err = p.parseBody()
 		case "cookie":
+			var bg Bag
+			if bg, err = p.parseBag(); err == nil {
+				req.cookies = append(req.cookies, bg)
+			}
 		case "username":
 			req.user, err = p.parseWord()
 		case "password":
 			req.pass, err = p.parseWord()
+		case "when":
+			req.when, err = p.parseScript(collect)
+		case "skipIf":
+			req.skip, err = p.parseScript(collect)
 		case "before":
 			req.before, err = p.parseScript(collect)
 		case "after":
 			req.after, err = p.parseScript(collect)
 		case "expect":
-			req.expect, err = p.parseExpect(collect)
+			if p.is(Ident) && p.curr.Literal == "schema" && p.peek.Type != EOL {
+				p.next()
+				req.schema, err = p.parseSchema(collect)
+				break
+			}
+			scripted := p.is(String) || p.is(Quote)
+			if req.expected, err = p.parseWord(); err == nil {
+				req.expect, req.assert, err = createExpect(req.expected, collect, scripted)
+			}
 		case "depends":
 			req.depends, err = p.parseDepends()
 		case "tls":
@@ -298,8 +446,62 @@ func (p *Parser) parseRequest(collect *Collection) error {
 }
 
 func (p *Parser) parseBody() (Body, error) {
-	defer p.next()
-	return PrepareBody(p.curr.Literal)
+	if p.is(Ident) && p.curr.Literal == "graphql" && p.peek.Type == Lbrace {
+		p.next()
+		return p.parseGraphqlBody()
+	}
+	w, err := p.parseWord()
+	if err != nil {
+		return nil, err
+	}
+	str, ok := w.(literal)
+	if !ok {
+		return nil, fmt.Errorf("body: only literal values can be used")
+	}
+	return PrepareBody(string(str))
+}
+
+func (p *Parser) parseGraphqlBody() (Body, error) {
+	if err := p.expect(Lbrace); err != nil {
+		return nil, err
+	}
+	defer p.skip(EOL)
+	var (
+		body  graphqlBody
+		track = createTracker()
+	)
+	for !p.done() && !p.is(Rbrace) {
+		p.skip(EOL)
+		if !p.is(Ident) && !p.is(Keyword) {
+			return nil, p.unexpected()
+		}
+		var (
+			kw  = p.curr.Literal
+			err error
+		)
+		if err = track.Seen(kw); err != nil {
+			return nil, err
+		}
+		p.next()
+		switch kw {
+		case "query":
+			body.query, err = p.parseWord()
+		case "operation":
+			body.operation, err = p.parseWord()
+		case "variables":
+			body.variables, err = p.parseBag()
+		default:
+			return nil, p.unexpected()
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.skip(EOL)
+	}
+	if body.query == nil {
+		return nil, fmt.Errorf("graphql: query is missing")
+	}
+	return body, p.expect(Rbrace)
 }
 
 func (p *Parser) parseScript(ev env.Environ[string]) (value.Evaluable, error) {
@@ -308,30 +510,42 @@ func (p *Parser) parseScript(ev env.Environ[string]) (value.Evaluable, error) {
 		return nil, err
 	}
 	str, err := w.Expand(ev)
-	if err == nil {
-		n, err := parser.ParseString(str)
-		if err != nil {
-			return nil, fmt.Errorf("enjoy: %s", err)
-		}
-		return eval.EvaluableNode(n), nil
+	if err != nil {
+		return nil, err
 	}
-	return nil, err
+	return compileScript(str)
 }
 
-func (p *Parser) parseExpect(ev env.Environ[string]) (ExpectFunc, error) {
-	w, err := p.parseWord()
+func (p *Parser) parseSchema(ev env.Environ[string]) (*jsonSchema, error) {
+	str, err := p.parseString(ev)
 	if err != nil {
 		return nil, err
 	}
+	return compileSchema(str)
+}
+
+// createExpect gives the check to run against the response. Status codes and
+// code ranges can be given as is but scripts have to be given between quotes
+// or in a heredoc so a misspelled range is not taken as a script.
+func createExpect(w Word, ev env.Environ[string], scripted bool) (ExpectFunc, value.Evaluable, error) {
 	n, err := w.ExpandInt(ev)
 	if err == nil {
-		return expectCode(n)
+		fn, err := expectCode(n)
+		return fn, nil, err
 	}
 	str, err := w.Expand(ev)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if isCodeRange(str) {
+		fn, err := expectCodeRange(str)
+		return fn, nil, err
 	}
-	return expectCodeRange(str)
+	if !scripted {
+		return nil, nil, fmt.Errorf("%s: unknown expectation", str)
+	}
+	script, err := compileScript(str)
+	return expectNothing, script, err
 }
 
 func (p *Parser) parseString(ev env.Environ[string]) (string, error) {
@@ -350,55 +564,71 @@ func (p *Parser) parseBool(ev env.Environ[string]) (bool, error) {
 	return w.ExpandBool(ev)
 }
 
-func (p *Parser) parseCertPool(ev env.Environ[string]) (*x509.CertPool, error) {
-	if p.is(EOL) {
-		return x509.SystemCertPool()
-	}
+func (p *Parser) parseInt(ev env.Environ[string]) (int, error) {
 	w, err := p.parseWord()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	str, err := w.Expand(ev)
+	return w.ExpandInt(ev)
+}
+
+func (p *Parser) parseDuration(ev env.Environ[string]) (time.Duration, error) {
+	str, err := p.parseString(ev)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	return time.ParseDuration(str)
+}
+
+func createCertPool(files []string) (*x509.CertPool, error) {
+	if len(files) == 0 {
+		return x509.SystemCertPool()
 	}
 	pool := x509.NewCertPool()
-	if i, err := os.Stat(str); err == nil {
-		if i.Mode().IsRegular() {
-			cert, err := os.ReadFile(str)
-			if err != nil {
-				return nil, err
-			}
-			pool.AppendCertsFromPEM(cert)
-			return pool, nil
-		} else if i.IsDir() {
-			files, err := os.ReadDir(str)
-			if err != nil {
-				return nil, err
-			}
-			for _, f := range files {
-				cert, err := os.ReadFile(filepath.Join(str, f.Name()))
-				if err != nil {
-					return nil, err
-				}
-				pool.AppendCertsFromPEM(cert)
-			}
-		} else {
-			return nil, fmt.Errorf("certificates can not be loaded from %s", i.Name())
+	for _, f := range files {
+		if err := appendCerts(pool, f); err != nil {
+			return nil, err
 		}
 	}
 	return pool, nil
 }
 
-func (p *Parser) parseVersionTLS(ev env.Environ[string]) (uint16, error) {
-	w, err := p.parseWord()
+func appendCerts(pool *x509.CertPool, file string) error {
+	i, err := os.Stat(file)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	str, err := w.Expand(ev)
-	if err != nil {
-		return 0, err
+	var files []string
+	switch {
+	case i.Mode().IsRegular():
+		files = append(files, file)
+	case i.IsDir():
+		es, err := os.ReadDir(file)
+		if err != nil {
+			return err
+		}
+		for _, e := range es {
+			if !e.Type().IsRegular() {
+				continue
+			}
+			files = append(files, filepath.Join(file, e.Name()))
+		}
+	default:
+		return fmt.Errorf("certificates can not be loaded from %s", i.Name())
+	}
+	for _, f := range files {
+		cert, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		if !pool.AppendCertsFromPEM(cert) && i.Mode().IsRegular() {
+			return fmt.Errorf("%s: no valid certificates found", f)
+		}
 	}
+	return nil
+}
+
+func versionTLS(str string) (uint16, error) {
 	var version uint16
 	switch strings.ToLower(str) {
 	default:
@@ -422,13 +652,16 @@ func (p *Parser) parseWord() (Word, error) {
 		if err != nil {
 			return nil, err
 		}
+		if w, ok := dat.(Word); ok {
+			return w, nil
+		}
 		str, _ := dat.(string)
 		return createLiteral(str), nil
 	case p.is(Quote):
 		return p.parseQuote()
 	case p.is(Variable):
 		defer p.next()
-		return createVariable(p.curr.Literal), nil
+		return parseVariable(p.curr.Literal)
 	default:
 		defer p.next()
 		return createLiteral(p.curr.Literal), nil
@@ -456,7 +689,7 @@ func (p *Parser) parseQuote() (Word, error) {
 
 func (p *Parser) parseKeyValues(set func(string, Word)) error {
 	p.skip(EOL)
-	if !p.is(Ident) {
+	if !p.isIdent() {
 		return p.unexpected()
 	}
 	ident := p.curr.Literal
@@ -520,7 +753,7 @@ func (p *Parser) parseVariables(collect *Collection) error {
 	defer p.skip(EOL)
 	for !p.done() && !p.is(Rbrace) {
 		p.skip(EOL)
-		if !p.is(Ident) {
+		if !p.isIdent() && !p.is(String) {
 			return p.unexpected()
 		}
 		var (
@@ -529,14 +762,16 @@ func (p *Parser) parseVariables(collect *Collection) error {
 		)
 		p.next()
 		switch {
-		case p.is(Ident) || p.is(String) || p.is(Number):
+		case p.isIdent() || p.is(String) || p.is(Number):
 			value = p.curr.Literal
 		case p.is(Variable):
-			v, err := collect.Resolve(p.curr.Literal)
+			w, err := parseVariable(p.curr.Literal)
 			if err != nil {
 				return err
 			}
-			value = v
+			if value, err = w.Expand(collect); err != nil {
+				return err
+			}
 		default:
 			return p.unexpected()
 		}
@@ -547,7 +782,7 @@ func (p *Parser) parseVariables(collect *Collection) error {
 	return p.expect(Rbrace)
 }
 
-func (p *Parser) parseTLS(env env.Environ[string]) (*tls.Config, error) {
+func (p *Parser) parseTLS(env env.Environ[string]) (*tlsConfig, error) {
 	if err := p.expect(Lbrace); err != nil {
 		return nil, err
 	}
@@ -561,35 +796,24 @@ func (p *Parser) parseTLS(env env.Environ[string]) (*tls.Config, error) {
 		if !p.is(Ident) && !p.is(Keyword) {
 			return nil, p.unexpected()
 		}
-		var (
-			kw  = p.curr.Literal
-			err error
-		)
-		if err = track.Seen(kw); err != nil {
+		kw := p.curr.Literal
+		if err := track.Seen(kw); err != nil {
 			return nil, err
 		}
-		p.next()
 		switch kw {
-		case "certFile":
-			cfg.certFile, err = p.parseString(env)
-		case "certKey":
-			cfg.certKey, err = p.parseString(env)
-		case "certCA":
-			cfg.Config.RootCAs, err = p.parseCertPool(env)
-		case "serverName":
-			cfg.Config.ServerName, err = p.parseString(env)
-		case "insecure":
-			cfg.Config.InsecureSkipVerify, err = p.parseBool(env)
-		case "minVersion":
-			cfg.Config.MinVersion, err = p.parseVersionTLS(env)
-		case "maxVersion":
-			cfg.Config.MaxVersion, err = p.parseVersionTLS(env)
+		case "certFile", "certKey", "certCA", "serverName", "insecure", "minVersion", "maxVersion":
 		default:
 			return nil, p.unexpected()
 		}
+		p.next()
+		list, err := p.parseDepends()
 		if err != nil {
 			return nil, err
 		}
+		if err := cfg.set(kw, list, env); err != nil {
+			return nil, err
+		}
+		cfg.options = append(cfg.options, pair{Key: kw, List: list})
 		p.skip(EOL)
 	}
 	if cfg.certFile != "" && cfg.certKey != "" {
@@ -599,7 +823,44 @@ func (p *Parser) parseTLS(env env.Environ[string]) (*tls.Config, error) {
 		}
 		cfg.Config.Certificates = append(cfg.Config.Certificates, cert)
 	}
-	return &cfg.Config, p.expect(Rbrace)
+	return &cfg, p.expect(Rbrace)
+}
+
+func (c *tlsConfig) set(option string, list []Word, ev env.Environ[string]) error {
+	var values []string
+	for _, w := range list {
+		str, err := w.Expand(ev)
+		if err != nil {
+			return err
+		}
+		values = append(values, str)
+	}
+	if option == "certCA" {
+		pool, err := createCertPool(values)
+		if err == nil {
+			c.Config.RootCAs = pool
+		}
+		return err
+	}
+	if len(values) != 1 {
+		return fmt.Errorf("%s: one value expected", option)
+	}
+	var err error
+	switch str := values[0]; option {
+	case "certFile":
+		c.certFile = str
+	case "certKey":
+		c.certKey = str
+	case "serverName":
+		c.Config.ServerName = str
+	case "insecure":
+		c.Config.InsecureSkipVerify, err = strconv.ParseBool(str)
+	case "minVersion":
+		c.Config.MinVersion, err = versionTLS(str)
+	case "maxVersion":
+		c.Config.MaxVersion, err = versionTLS(str)
+	}
+	return err
 }
 
 func (p *Parser) parseCollectionTLS(collect *Collection) error {
@@ -611,6 +872,102 @@ func (p *Parser) parseCollectionTLS(collect *Collection) error {
 	return err
 }
 
+func (p *Parser) parseCollectionProxy(collect *Collection) error {
+	p.next()
+	var err error
+	collect.proxy, err = p.parseWord()
+	return err
+}
+
+func (p *Parser) parseCollectionNoProxy(collect *Collection) error {
+	p.next()
+	var err error
+	collect.noproxy, err = p.parseDepends()
+	return err
+}
+
+func (p *Parser) parseCollectionTransport(collect *Collection) error {
+	p.next()
+	cfg, err := p.parseTransport(collect)
+	if err == nil {
+		collect.transport = cfg
+	}
+	return err
+}
+
+// parseCollectionRate reads the rate of the requests of a collection given as a
+// number of requests per second or as the minimum interval between requests.
+func (p *Parser) parseCollectionRate(collect *Collection) error {
+	p.next()
+	str, err := p.parseString(collect)
+	if err != nil {
+		return err
+	}
+	var interval time.Duration
+	if n, err := strconv.ParseFloat(str, 64); err == nil {
+		if n <= 0 {
+			return fmt.Errorf("%s: rate should be greater than 0", str)
+		}
+		interval = time.Duration(float64(time.Second) / n)
+	} else if interval, err = time.ParseDuration(str); err != nil {
+		return fmt.Errorf("%s: invalid rate", str)
+	}
+	collect.rate = &rateLimit{
+		interval: interval,
+	}
+	return nil
+}
+
+func (p *Parser) parseTransport(env env.Environ[string]) (*transportConfig, error) {
+	if err := p.expect(Lbrace); err != nil {
+		return nil, err
+	}
+	defer p.skip(EOL)
+	var (
+		cfg   transportConfig
+		track = createTracker()
+	)
+	for !p.done() && !p.is(Rbrace) {
+		p.skip(EOL)
+		if !p.is(Ident) && !p.is(Keyword) {
+			return nil, p.unexpected()
+		}
+		var (
+			kw  = p.curr.Literal
+			err error
+		)
+		if err = track.Seen(kw); err != nil {
+			return nil, err
+		}
+		p.next()
+		switch kw {
+		case "maxIdleConns":
+			cfg.maxIdle, err = p.parseInt(env)
+		case "maxIdleConnsPerHost":
+			cfg.maxIdlePerHost, err = p.parseInt(env)
+		case "maxConnsPerHost":
+			cfg.maxConnPerHost, err = p.parseInt(env)
+		case "idleTimeout":
+			cfg.idleTimeout, err = p.parseDuration(env)
+		case "keepAlive":
+			var ok bool
+			ok, err = p.parseBool(env)
+			cfg.noKeepAlive = !ok
+		case "http2":
+			var ok bool
+			ok, err = p.parseBool(env)
+			cfg.noHttp2 = !ok
+		default:
+			return nil, p.unexpected()
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.skip(EOL)
+	}
+	return &cfg, p.expect(Rbrace)
+}
+
 func (p *Parser) parseCollectionScript(collect *Collection) error {
 	ident := p.curr.Literal
 	p.next()
@@ -623,6 +980,10 @@ func (p *Parser) parseCollectionScript(collect *Collection) error {
 		collect.beforeEach = append(collect.beforeEach, ev)
 	case "afterEach":
 		collect.afterEach = append(collect.afterEach, ev)
+	case "before":
+		collect.before = append(collect.before, ev)
+	case "after":
+		collect.after = append(collect.after, ev)
 	default:
 	}
 	return nil
@@ -637,6 +998,15 @@ func (p *Parser) parseCollectionQuery(collect *Collection) error {
 	return err
 }
 
+func (p *Parser) parseCollectionCookie(collect *Collection) error {
+	p.next()
+	bg, err := p.parseBag()
+	if err == nil {
+		collect.cookies = append(collect.cookies, bg)
+	}
+	return err
+}
+
 func (p *Parser) parseCollectionHeaders(collect *Collection) error {
 	p.next()
 	bg, err := p.parseBag()
@@ -646,6 +1016,25 @@ func (p *Parser) parseCollectionHeaders(collect *Collection) error {
 	return err
 }
 
+func (p *Parser) parseCollectionHeadersMode(collect *Collection) error {
+	mode := p.curr.Literal
+	p.next()
+	if !p.is(Keyword) || p.curr.Literal != "headers" {
+		return p.unexpected()
+	}
+	p.next()
+	bg, err := p.parseBag()
+	if err != nil {
+		return err
+	}
+	if mode == "force" {
+		collect.forced = bg
+	} else {
+		collect.defaults = bg
+	}
+	return nil
+}
+
 func (p *Parser) skip(kind rune) {
 	for p.is(kind) {
 		p.next()
@@ -669,6 +1058,13 @@ func (p *Parser) is(kind rune) bool {
 	return p.curr.Type == kind
 }
 
+// isIdent reports whether the current token can be used as a name. Keywords
+// are only special at the start of a statement and can be used as names of
+// requests, collections, variables and keys of bags.
+func (p *Parser) isIdent() bool {
+	return p.is(Ident) || p.is(Keyword)
+}
+
 func (p *Parser) done() bool {
 	return p.is(EOF)
 }
@@ -686,6 +1082,81 @@ func (p *Parser) unregisterMacroFunc(name string) {
 	delete(p.macros, name)
 }
 
+func readEnvData(buf []byte) (map[string]string, error) {
+	vars := make(map[string]string)
+	for i, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%d: missing = in line", i+1)
+		}
+		value = strings.TrimSpace(value)
+		if n := len(value); n >= 2 && (value[0] == dquote || value[0] == squote) && value[0] == value[n-1] {
+			value = value[1 : n-1]
+		}
+		vars[strings.TrimSpace(key)] = value
+	}
+	return vars, nil
+}
+
+func readJSONData(buf []byte) (map[string]string, error) {
+	var data map[string]any
+	if err := json.Unmarshal(buf, &data); err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string)
+	flattenData("", data, vars)
+	return vars, nil
+}
+
+func flattenData(prefix string, data any, vars map[string]string) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+	switch d := data.(type) {
+	case map[string]any:
+		for k, v := range d {
+			flattenData(join(k), v, vars)
+		}
+	case []any:
+		for i, v := range d {
+			flattenData(join(strconv.Itoa(i)), v, vars)
+		}
+	case string:
+		vars[prefix] = d
+	case float64:
+		vars[prefix] = strconv.FormatFloat(d, 'f', -1, 64)
+	case bool:
+		vars[prefix] = strconv.FormatBool(d)
+	default:
+		vars[prefix] = ""
+	}
+}
+
+type script struct {
+	value.Evaluable
+	source string
+}
+
+func compileScript(str string) (value.Evaluable, error) {
+	n, err := parser.ParseString(str)
+	if err != nil {
+		return nil, fmt.Errorf("enjoy: %s", err)
+	}
+	s := script{
+		Evaluable: eval.EvaluableNode(n),
+		source:    str,
+	}
+	return s, nil
+}
+
 type tracker[T comparable] struct {
 	seen  map[T]struct{}
 	empty struct{}
@@ -0,0 +1,443 @@
+package mule
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/midbel/enjoy/env"
+)
+
+func parseString(str string) (*Collection, error) {
+	return NewParser(strings.NewReader(str)).Parse()
+}
+
+func TestParseExpect(t *testing.T) {
+	tests := []struct {
+		Expect string
+		Script bool
+		Fail   bool
+	}{
+		{Expect: "200"},
+		{Expect: "'404'"},
+		{Expect: "success"},
+		{Expect: "server-error"},
+		{Expect: "sucess", Fail: true},
+		{Expect: "mule", Fail: true},
+		{Expect: "'mule.response.code == 200'", Script: true},
+		{Expect: "<<SCRIPT\nif (mule.response.code != 200) {\n\tthrow 'unexpected code'\n}\nSCRIPT", Script: true},
+	}
+	for _, tt := range tests {
+		src := "get test {\n\turl 'http://localhost/test'\n\texpect " + tt.Expect + "\n}\n"
+		c, err := parseString(src)
+		if tt.Fail {
+			if err == nil {
+				t.Errorf("%s: expected error but parsing succeeded", tt.Expect)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.Expect, err)
+			continue
+		}
+		r := c.requests[0]
+		if tt.Script && r.assert == nil {
+			t.Errorf("%s: expected script", tt.Expect)
+		}
+		if !tt.Script && r.assert != nil {
+			t.Errorf("%s: unexpected script", tt.Expect)
+		}
+	}
+}
+
+func TestReadEnvData(t *testing.T) {
+	tests := []struct {
+		Input string
+		Want  map[string]string
+		Fail  bool
+	}{
+		{
+			Input: "",
+			Want:  map[string]string{},
+		},
+		{
+			Input: "# comment\n\nuser=mule\n  pass = secret  \n",
+			Want:  map[string]string{"user": "mule", "pass": "secret"},
+		},
+		{
+			Input: "export token=abc\nempty=",
+			Want:  map[string]string{"token": "abc", "empty": ""},
+		},
+		{
+			Input: "double=\"hello world\"\nsingle='a=b'\nmixed=\"foo'",
+			Want:  map[string]string{"double": "hello world", "single": "a=b", "mixed": "\"foo'"},
+		},
+		{
+			Input: "user=mule\ninvalid",
+			Fail:  true,
+		},
+	}
+	for _, tt := range tests {
+		got, err := readEnvData([]byte(tt.Input))
+		if tt.Fail {
+			if err == nil {
+				t.Errorf("%q: expected error but got %v", tt.Input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tt.Input, err)
+			continue
+		}
+		if !maps.Equal(got, tt.Want) {
+			t.Errorf("%q: variables mismatched! want %v, got %v", tt.Input, tt.Want, got)
+		}
+	}
+}
+
+func TestReadJSONData(t *testing.T) {
+	tests := []struct {
+		Input string
+		Want  map[string]string
+		Fail  bool
+	}{
+		{
+			Input: `{}`,
+			Want:  map[string]string{},
+		},
+		{
+			Input: `{"user": "mule", "port": 8080, "ratio": 0.5, "debug": true, "none": null}`,
+			Want:  map[string]string{"user": "mule", "port": "8080", "ratio": "0.5", "debug": "true", "none": ""},
+		},
+		{
+			Input: `{"db": {"host": "localhost", "hosts": ["a", "b"]}}`,
+			Want:  map[string]string{"db.host": "localhost", "db.hosts.0": "a", "db.hosts.1": "b"},
+		},
+		{
+			Input: `["a", "b"]`,
+			Fail:  true,
+		},
+		{
+			Input: `{"user": }`,
+			Fail:  true,
+		},
+	}
+	for _, tt := range tests {
+		got, err := readJSONData([]byte(tt.Input))
+		if tt.Fail {
+			if err == nil {
+				t.Errorf("%s: expected error but got %v", tt.Input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.Input, err)
+			continue
+		}
+		if !maps.Equal(got, tt.Want) {
+			t.Errorf("%s: variables mismatched! want %v, got %v", tt.Input, tt.Want, got)
+		}
+	}
+}
+
+func TestParseReadFileMacro(t *testing.T) {
+	const src = `get test {
+	url 'http://localhost/test'
+	headers {
+		x-signature  @base64 @readfile 'signature.bin'
+		x-request-id @uuid
+		accept       'text/plain'
+	}
+}
+`
+	dir := t.TempDir()
+	files := map[string]string{
+		"test.mu":       src,
+		"signature.bin": "signature",
+	}
+	for file, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0o644); err != nil {
+			t.Fatalf("unexpected error writing %s: %s", file, err)
+		}
+	}
+	r, err := os.Open(filepath.Join(dir, "test.mu"))
+	if err != nil {
+		t.Fatalf("unexpected error opening file: %s", err)
+	}
+	defer r.Close()
+
+	c, err := NewParser(r).Parse()
+	if err != nil {
+		t.Fatalf("unexpected error parsing file: %s", err)
+	}
+	req := c.requests[0]
+	hdr, err := req.headers.Header(env.EmptyEnv[string]())
+	if err != nil {
+		t.Fatalf("unexpected error expanding headers: %s", err)
+	}
+	if got := hdr.Values("x-signature"); len(got) != 1 || got[0] != "c2lnbmF0dXJl" {
+		t.Errorf("signature mismatched! want [c2lnbmF0dXJl], got %s", got)
+	}
+	if got := hdr.Values("x-request-id"); len(got) != 1 {
+		t.Errorf("request id mismatched! want 1 value, got %s", got)
+	}
+	if got := hdr.Get("accept"); got != "text/plain" {
+		t.Errorf("accept mismatched! want text/plain, got %s", got)
+	}
+}
+
+func TestParseKeywordsAsNames(t *testing.T) {
+	const src = `
+variables {
+	proxy   http://proxy:3128
+	rate    10
+	default get
+}
+headers {
+	force yes
+}
+query {
+	rate 10
+}
+collection transport {
+	environment default {
+		variables {
+			url http://localhost
+		}
+	}
+	get transport {
+		url 'http://localhost/transport'
+		query {
+			rate    ${rate}
+			default true
+		}
+		cookie {
+			name   proxy
+			value  on
+			domain localhost
+		}
+	}
+}
+post rate {
+	url 'http://localhost/rate'
+	headers {
+		environment dev
+	}
+}
+`
+	c, err := parseString(src)
+	if err != nil {
+		t.Fatalf("unexpected error parsing collection: %s", err)
+	}
+	vars := []struct {
+		Name string
+		Want string
+	}{
+		{Name: "proxy", Want: "http://proxy:3128"},
+		{Name: "rate", Want: "10"},
+		{Name: "default", Want: "get"},
+	}
+	for _, v := range vars {
+		got, err := c.Resolve(v.Name)
+		if err != nil || got != v.Want {
+			t.Errorf("%s: variable mismatched! want %s, got %s (%v)", v.Name, v.Want, got, err)
+		}
+	}
+	hdr, err := c.headers.Header(c)
+	if err != nil || hdr.Get("force") != "yes" {
+		t.Errorf("force: header mismatched! want yes, got %s (%v)", hdr.Get("force"), err)
+	}
+	if _, err := c.GetRequest("rate"); err != nil {
+		t.Errorf("rate: request not found")
+	}
+	sub, err := c.GetCollection("transport")
+	if err != nil {
+		t.Fatalf("transport: collection not found")
+	}
+	if _, err := sub.GetRequest("transport"); err != nil {
+		t.Errorf("transport: request not found")
+	}
+	if err := sub.SetEnvironment("default"); err != nil {
+		t.Errorf("default: environment not found")
+	}
+
+	var first bytes.Buffer
+	if err := c.Format(&first); err != nil {
+		t.Fatalf("unexpected error formatting collection: %s", err)
+	}
+	other, err := parseString(first.String())
+	if err != nil {
+		t.Fatalf("unexpected error parsing formatted collection: %s\n%s", err, first.String())
+	}
+	var second bytes.Buffer
+	if err := other.Format(&second); err != nil {
+		t.Fatalf("unexpected error formatting parsed collection: %s", err)
+	}
+	if first.String() != second.String() {
+		t.Errorf("formatted collections mismatched!\nwant:\n%s\ngot:\n%s", first.String(), second.String())
+	}
+}
+
+func TestParseTLS(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificate(t, dir)
+
+	client, err := os.ReadFile(filepath.Join(dir, "client.pem"))
+	if err != nil {
+		t.Fatalf("unexpected error reading client certificate: %s", err)
+	}
+	clients := x509.NewCertPool()
+	clients.AppendCertsFromPEM(client)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(handler))
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clients,
+	}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	block := pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: srv.Certificate().Raw,
+	}
+	server := filepath.Join(dir, "server.pem")
+	if err := os.WriteFile(server, pem.EncodeToMemory(&block), 0o600); err != nil {
+		t.Fatalf("unexpected error writing server certificate: %s", err)
+	}
+
+	var (
+		certFile = fmt.Sprintf("certFile %q", filepath.Join(dir, "client.pem"))
+		certKey  = fmt.Sprintf("certKey %q", filepath.Join(dir, "client.key"))
+		certCA   = fmt.Sprintf("certCA %q", server)
+	)
+	tests := []struct {
+		Name   string
+		Config []string
+		Fail   bool
+	}{
+		{
+			Name:   "custom-ca",
+			Config: []string{certFile, certKey, certCA},
+		},
+		{
+			Name:   "insecure",
+			Config: []string{certFile, certKey, "insecure true"},
+		},
+		{
+			Name:   "unknown-ca",
+			Config: []string{certFile, certKey},
+			Fail:   true,
+		},
+		{
+			Name:   "no-client-cert",
+			Config: []string{certCA},
+			Fail:   true,
+		},
+	}
+	for _, tt := range tests {
+		src := fmt.Sprintf("tls {\n\t%s\n}\nget test {\n\turl %q\n\texpect 200\n}\n", strings.Join(tt.Config, "\n\t"), srv.URL)
+		c, err := parseString(src)
+		if err != nil {
+			t.Errorf("%s: unexpected error parsing collection: %s", tt.Name, err)
+			continue
+		}
+		err = c.Run("test", io.Discard)
+		if tt.Fail {
+			if err == nil {
+				t.Errorf("%s: expected error but request succeeded", tt.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error running request: %s", tt.Name, err)
+		}
+	}
+}
+
+func TestParseNestedVariables(t *testing.T) {
+	const (
+		main = `
+variables {
+	host 'api.example.com'
+}
+@include 'remote.mu'
+collection first {
+	collection second {
+		collection third {
+			get deep {
+				url "http://${host}/deep"
+			}
+		}
+	}
+}
+`
+		remote = `
+collection remote {
+	get item {
+		url "http://${host}/item"
+	}
+}
+`
+	)
+	dir := t.TempDir()
+	for file, str := range map[string]string{"main.mu": main, "remote.mu": remote} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(str), 0o644); err != nil {
+			t.Fatalf("unexpected error writing %s: %s", file, err)
+		}
+	}
+	c, err := Open(filepath.Join(dir, "main.mu"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing collection: %s", err)
+	}
+	tests := []struct {
+		Path []string
+		Name string
+		Want string
+	}{
+		{Path: []string{"first", "second", "third"}, Name: "deep", Want: "http://api.example.com/deep"},
+		{Path: []string{"", "remote"}, Name: "item", Want: "http://api.example.com/item"},
+	}
+	for _, tt := range tests {
+		var (
+			sub = c
+			err error
+		)
+		for _, n := range tt.Path {
+			if sub, err = sub.GetCollection(n); err != nil {
+				t.Fatalf("%s: collection not found", n)
+			}
+		}
+		q, err := sub.GetRequest(tt.Name)
+		if err != nil {
+			t.Fatalf("%s: request not found", tt.Name)
+		}
+		ctx, err := MuleContext(sub)
+		if err != nil {
+			t.Fatalf("unexpected error creating context: %s", err)
+		}
+		req, err := q.Prepare(ctx)
+		if err != nil {
+			t.Errorf("%s: unexpected error preparing request: %s", tt.Name, err)
+			continue
+		}
+		if got := req.URL.String(); got != tt.Want {
+			t.Errorf("%s: url mismatched! want %s, got %s", tt.Name, tt.Want, got)
+		}
+	}
+}
@@ -2,12 +2,21 @@ package mule
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
 	"os"
+	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,7 +33,12 @@ type Request struct {
 	depends []Word
 	retry   Word
 	timeout Word
-	config  *tls.Config
+	stream  Word
+	output  Word
+	dir     string
+	proxy   Word
+	noproxy []Word
+	config  *tlsConfig
 
 	location Word
 	user     Word
@@ -33,9 +47,14 @@ type Request struct {
 	headers  Bag
 	body     Body
 
-	cookies []Bag
-	expect  func(*http.Response) error
+	cookies  []Bag
+	expected Word
+	schema   *jsonSchema
+	expect   func(*http.Response) error
+	assert   value.Evaluable
 
+	when   value.Evaluable
+	skip   value.Evaluable
 	before value.Evaluable
 	after  value.Evaluable
 }
@@ -54,54 +73,273 @@ func Prepare(name, method string) Request {
 }
 
 func (r Request) Execute(ctx *Context) (*http.Response, error) {
-	req, err := r.Prepare(ctx.root)
+	req, mule, err := r.build(ctx)
 	if err != nil {
 		return nil, err
 	}
 	if req.Body != nil {
 		defer req.Body.Close()
 	}
+	var trace timing
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.Trace()))
 
-	ctx.RegisterProp("request", createRequestValue(req))
-	ctx.RegisterProp("response", value.Undefined())
-
-	mule := muleEnv(ctx)
-	mule.Define(reqUri, value.CreateString(req.URL.String()), true)
-	mule.Define(reqName, value.CreateString(r.Name), true)
+	var (
+		sent    []byte
+		cookies []*http.Cookie
+	)
+	if ctx.har != nil {
+		cookies = ctx.jar.Cookies(req.URL)
+	}
+	if ctx.har != nil && req.Body != nil {
+		if sent, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(sent))
+	}
 
-	if err := r.executeBefore(ctx.root, mule); err != nil {
+	client, err := r.getClient(ctx)
+	if err != nil {
 		return nil, err
 	}
-	var (
-		elapsed time.Duration
-		client  = r.getClient(ctx.root.config)
-		now     = time.Now()
-	)
+	if ctx.root.rate != nil {
+		ctx.root.rate.Wait()
+	}
+	req, cancel, err := r.withTimeout(req, ctx.vars)
+	if err != nil {
+		return nil, err
+	}
+	ctx.verbose.Request(req)
+	trace.start = time.Now()
 	res, err := client.Do(req)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
-	elapsed = time.Since(now)
-	defer res.Body.Close()
-
-	ctx.RegisterProp("response", createResponseValue(res))
+	res.Body = cancelBody{
+		ReadCloser: res.Body,
+		cancel:     cancel,
+	}
+	ctx.verbose.Response(res)
+	ctx.RegisterProp("request", createRequestValue(req, true))
+	elapsed := time.Since(trace.start)
 
-	var (
-		tmp bytes.Buffer
-		str bytes.Buffer
-	)
-	if _, err := io.Copy(io.MultiWriter(&tmp, &str), res.Body); err != nil {
+	fail := func(err error) (*http.Response, error) {
+		res.Body.Close()
 		return nil, err
 	}
-	body := strings.TrimSpace(str.String())
+	stream, err := r.isStreamed(ctx.vars)
+	if err != nil {
+		return fail(err)
+	}
+	var tmp bytes.Buffer
+	if !stream {
+		defer res.Body.Close()
+		if _, err := io.Copy(&tmp, res.Body); err != nil {
+			return nil, err
+		}
+		if err := decompress(res, &tmp); err != nil {
+			return nil, err
+		}
+	}
+	trace.done = time.Now()
+	if ctx.har != nil {
+		ctx.har.Record(req, sent, cookies, res, tmp.Bytes(), &trace)
+	}
+
+	body := strings.TrimSpace(tmp.String())
+	ctx.RegisterProp("response", createResponseValue(res, tmp.Bytes(), &trace))
 	mule.Define(reqDuration, value.CreateFloat(elapsed.Seconds()), true)
 	mule.Define(resStatus, value.CreateFloat(float64(res.StatusCode)), true)
 	mule.Define(resBody, value.CreateString(body), true)
 	if err := r.executeAfter(ctx.root, mule); err != nil {
-		return nil, err
+		return fail(err)
+	}
+	if err := r.expect(res); err != nil {
+		return fail(err)
+	}
+	if stream {
+		return res, nil
+	}
+	if r.assert != nil {
+		if _, err := r.assert.Eval(mule); err != nil {
+			return fail(fmt.Errorf("%s: expectation failed: %s", r.Name, err))
+		}
+	}
+	if r.schema != nil {
+		if err := r.schema.Validate(tmp.Bytes()); err != nil {
+			return fail(fmt.Errorf("%s: %w", r.Name, err))
+		}
 	}
 	res.Body = io.NopCloser(&tmp)
-	return res, r.expect(res)
+	return res, nil
+}
+
+// Dump writes the request as it would be sent to the server after running the
+// before scripts without sending it.
+func (r Request) Dump(ctx *Context, w io.Writer) error {
+	req, _, err := r.build(ctx)
+	if err != nil {
+		return err
+	}
+	buf, err := httputil.DumpRequestOut(req, true)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", bytes.TrimSpace(buf))
+	return err
+}
+
+// Curl writes the curl command to use to send the request after running the
+// before scripts.
+func (r Request) Curl(ctx *Context, w io.Writer) error {
+	req, _, err := r.build(ctx)
+	if err != nil {
+		return err
+	}
+	var (
+		args = []string{"curl", "-X", req.Method, shellQuote(req.URL.String())}
+		keys = make([]string, 0, len(req.Header))
+	)
+	for k := range req.Header {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		for _, v := range req.Header[k] {
+			args = append(args, "-H", shellQuote(k+": "+v))
+		}
+	}
+	if req.Body != nil {
+		defer req.Body.Close()
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		if len(body) > 0 {
+			args = append(args, "--data-binary", shellQuote(string(body)))
+		}
+	}
+	_, err = fmt.Fprintln(w, strings.Join(args, " "))
+	return err
+}
+
+func shellQuote(str string) string {
+	return "'" + strings.ReplaceAll(str, "'", `'\''`) + "'"
+}
+
+func (r Request) build(ctx *Context) (*http.Request, env.Environ[value.Value], error) {
+	req, err := r.Prepare(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx.RegisterProp("request", createRequestValue(req, false))
+	ctx.RegisterProp("response", value.Undefined())
+
+	mule := muleEnv(ctx)
+	mule.Define(reqUri, value.CreateString(req.URL.String()), true)
+	mule.Define(reqName, value.CreateString(r.Name), true)
+
+	if err := r.executeBefore(ctx.root, mule); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, nil, err
+	}
+	return req, mule, nil
+}
+
+// withTimeout gives the request with the timeout of the request applied and
+// the function to call to release it. The timeout covers the sending of the
+// request and the reading of its response. It is given as a duration or as a
+// number of seconds.
+func (r Request) withTimeout(req *http.Request, ev env.Environ[string]) (*http.Request, context.CancelFunc, error) {
+	if r.timeout == nil {
+		return req, func() {}, nil
+	}
+	str, err := r.timeout.Expand(ev)
+	if err != nil {
+		return nil, nil, err
+	}
+	timeout, err := time.ParseDuration(str)
+	if n, e := strconv.Atoi(str); e == nil {
+		timeout, err = time.Duration(n)*time.Second, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: invalid timeout", str)
+	}
+	sub, cancel := context.WithTimeout(req.Context(), timeout)
+	return req.WithContext(sub), cancel, nil
+}
+
+// cancelBody releases the resources of the timeout of a request once its
+// body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// isStreamed reports whether the body of the response should be given as is
+// to the caller instead of being buffered first. In this mode, the body is
+// not available to the after scripts and only the status code expectations
+// are checked: the expect scripts and the schema are ignored.
+func (r Request) isStreamed(ev env.Environ[string]) (bool, error) {
+	if r.stream == nil {
+		return false, nil
+	}
+	return r.stream.ExpandBool(ev)
+}
+
+// openOutput creates the file where the body of the response should be
+// written. The name of the request is available as requestName to build the
+// path of the file. Like the files read by the macros, a relative path is
+// relative to the directory of the file defining the request.
+func (r Request) openOutput(ctx *Context) (io.WriteCloser, error) {
+	if r.output == nil {
+		return nil, nil
+	}
+	ev := env.EnclosedEnv[string](ctx.vars)
+	ev.Define(reqName, r.Name, true)
+
+	file, err := r.output.Expand(ev)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(r.dir, file)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(file)
+}
+
+// Runnable evaluates the when and skipIf conditions of the request. The
+// request should not be executed when the when condition is false or when the
+// skipIf condition is true.
+func (r Request) Runnable(ctx *Context) (bool, error) {
+	if r.when == nil && r.skip == nil {
+		return true, nil
+	}
+	mule := muleEnv(ctx)
+	mule.Define(reqName, value.CreateString(r.Name), true)
+	if r.when != nil {
+		v, err := r.when.Eval(mule)
+		if err != nil || !v.True() {
+			return false, err
+		}
+	}
+	if r.skip != nil {
+		v, err := r.skip.Eval(mule)
+		if err != nil || v.True() {
+			return false, err
+		}
+	}
+	return true, nil
 }
 
 func (r Request) Depends(ev env.Environ[string]) ([]string, error) {
@@ -116,64 +354,127 @@ func (r Request) Depends(ev env.Environ[string]) ([]string, error) {
 	return list, nil
 }
 
-func (r Request) Prepare(root *Collection) (*http.Request, error) {
+func (r Request) Prepare(ctx *Context) (*http.Request, error) {
+	root := ctx.root
 	if r.user == nil && root.user != nil {
 		r.user = root.user
 	}
 	if r.pass == nil && root.pass != nil {
 		r.pass = root.pass
 	}
-	req, err := r.getRequest(root)
+	req, err := r.getRequest(ctx.vars)
 	if err != nil {
 		return nil, err
 	}
-	return req, r.setHeaders(req, root)
+	if err := r.setHeaders(req, ctx.vars); err != nil {
+		return nil, err
+	}
+	return req, setCollectionHeaders(req, root, ctx.vars)
+}
+
+// setCollectionHeaders applies the default and forced headers of the
+// collection of the request and of its parents. A default header is only set
+// when the request does not have it yet. A forced header replaces the value of
+// the request. The headers of the nearest collection take precedence.
+func setCollectionHeaders(req *http.Request, root *Collection, ev env.Environ[string]) error {
+	var list []*Collection
+	for c := root; c != nil; c = c.parent {
+		list = append(list, c)
+	}
+	for _, c := range list {
+		if c.defaults == nil {
+			continue
+		}
+		hdr, err := c.defaults.Header(ev)
+		if err != nil {
+			return err
+		}
+		for k, vs := range hdr {
+			if _, ok := req.Header[k]; !ok {
+				req.Header[k] = vs
+			}
+		}
+	}
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i].forced == nil {
+			continue
+		}
+		hdr, err := list[i].forced.Header(ev)
+		if err != nil {
+			return err
+		}
+		for k, vs := range hdr {
+			req.Header[k] = vs
+		}
+	}
+	return nil
 }
 
-func (r Request) getClient(root *tls.Config) http.Client {
-	var client http.Client
-	if cfg := r.getTLS(root); cfg != nil {
-		client.Transport = &http.Transport{
-			TLSClientConfig: cfg,
+func (r Request) getClient(ctx *Context) (*http.Client, error) {
+	key := clientKey{
+		tls:       r.getTLS(ctx.root.config),
+		transport: ctx.root.transport,
+	}
+	proxy, noproxy := r.proxy, r.noproxy
+	if proxy == nil {
+		proxy, noproxy = ctx.root.proxy, ctx.root.noproxy
+	}
+	if proxy != nil {
+		str, err := proxy.Expand(ctx.vars)
+		if err != nil {
+			return nil, err
+		}
+		key.proxy = str
+
+		var hosts []string
+		for _, w := range noproxy {
+			str, err := w.Expand(ctx.vars)
+			if err != nil {
+				return nil, err
+			}
+			hosts = append(hosts, str)
 		}
+		key.noproxy = strings.Join(hosts, ",")
 	}
-	return client
+	return ctx.getClient(key)
 }
 
-func (r Request) getTLS(parent *tls.Config) *tls.Config {
-	if r.config != nil {
-		return r.config
+func (r Request) getTLS(parent *tlsConfig) *tls.Config {
+	cfg := r.config
+	if cfg == nil {
+		cfg = parent
 	}
-	return parent
+	if cfg == nil {
+		return nil
+	}
+	return &cfg.Config
 }
 
-func (r Request) getRequest(root *Collection) (*http.Request, error) {
+func (r Request) getRequest(ev env.Environ[string]) (*http.Request, error) {
 	var body io.Reader
 	if r.body != nil {
-		tmp, err := r.body.Open()
+		tmp, err := r.body.Open(ev)
 		if err != nil {
 			return nil, err
 		}
-		body = tmp
-	}
-	uri, err := r.location.ExpandURL(root)
-	if err != nil {
-		return nil, err
-	}
-	if uri.Host == "" && root.base != nil {
-		parent, err := root.base.ExpandURL(root)
+		defer tmp.Close()
+
+		buf, err := io.ReadAll(tmp)
 		if err != nil {
 			return nil, err
 		}
-		uri.Host = parent.Host
-		uri.Scheme = parent.Scheme
+		body = bytes.NewReader(buf)
 	}
-	query, err := r.query.ValuesWith(root, uri.Query())
+	uri, err := r.location.ExpandURL(ev)
+	if err != nil {
+		return nil, err
+	}
+	query, err := r.query.ValuesWith(ev, uri.Query())
 	if err != nil {
 		return nil, err
 	}
 	uri.RawQuery = query.Encode()
-	return http.NewRequest(r.method, uri.String(), body)
+	return http.NewRequest(strings.ToUpper(r.method), uri.String(), body)
 }
 
 func (r Request) setHeaders(req *http.Request, ev env.Environ[string]) error {
@@ -182,6 +483,9 @@ func (r Request) setHeaders(req *http.Request, ev env.Environ[string]) error {
 		return err
 	}
 	req.Header = hdr
+	if b, ok := r.body.(interface{ ContentType() string }); ok && hdr.Get("Content-Type") == "" {
+		hdr.Set("Content-Type", b.ContentType())
+	}
 	if hdr.Get("Authorization") == "" && r.user != nil && r.pass != nil {
 		u, err := r.user.Expand(ev)
 		if err != nil {
@@ -219,24 +523,142 @@ func (r Request) executeScripts(scripts []value.Evaluable, ctx env.Environ[value
 	return nil
 }
 
+// executeBefore runs the before scripts of the collections from the outermost
+// one to the collection of the request, then the beforeEach scripts of the
+// collection and finally the before script of the request.
 func (r Request) executeBefore(root *Collection, ctx env.Environ[value.Value]) error {
-	tmp := slices.Clone(root.beforeEach)
+	var tmp []value.Evaluable
+	for c := root; c != nil; c = c.parent {
+		tmp = append(slices.Clone(c.before), tmp...)
+	}
+	tmp = append(tmp, root.beforeEach...)
 	if r.before != nil {
 		tmp = append(tmp, r.before)
 	}
 	return r.executeScripts(tmp, ctx)
 }
 
+// executeAfter runs the afterEach scripts of the collection, the after script
+// of the request then the after scripts of the collections from the collection
+// of the request to the outermost one.
 func (r Request) executeAfter(root *Collection, ctx env.Environ[value.Value]) error {
 	tmp := slices.Clone(root.afterEach)
 	if r.after != nil {
 		tmp = append(tmp, r.after)
 	}
+	for c := root; c != nil; c = c.parent {
+		tmp = append(tmp, c.after...)
+	}
 	return r.executeScripts(tmp, ctx)
 }
 
+var redactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// logger writes the requests sent and the status and headers of the responses
+// received. The values of the headers carrying credentials are redacted unless
+// secrets is set.
+type logger struct {
+	w       io.Writer
+	secrets bool
+}
+
+func (g *logger) Request(req *http.Request) {
+	if g == nil {
+		return
+	}
+	fmt.Fprintf(g.w, "> %s %s %s\n", req.Method, req.URL, req.Proto)
+	g.headers(">", req.Header)
+}
+
+func (g *logger) Response(res *http.Response) {
+	if g == nil {
+		return
+	}
+	fmt.Fprintf(g.w, "< %s %s\n", res.Proto, res.Status)
+	g.headers("<", res.Header)
+}
+
+func (g *logger) headers(prefix string, hdr http.Header) {
+	keys := make([]string, 0, len(hdr))
+	for k := range hdr {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		for _, v := range hdr[k] {
+			if !g.secrets && slices.Contains(redactedHeaders, http.CanonicalHeaderKey(k)) {
+				v = "[redacted]"
+			}
+			fmt.Fprintf(g.w, "%s %s: %s\n", prefix, k, v)
+		}
+	}
+	fmt.Fprintln(g.w, prefix)
+}
+
+// timing records when each step of a request happened.
+type timing struct {
+	start     time.Time
+	dnsStart  time.Time
+	dnsDone   time.Time
+	connStart time.Time
+	connDone  time.Time
+	tlsStart  time.Time
+	tlsDone   time.Time
+	firstByte time.Time
+	done      time.Time
+}
+
+func (t *timing) Trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(_ httptrace.DNSStartInfo) {
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(_ httptrace.DNSDoneInfo) {
+			t.dnsDone = time.Now()
+		},
+		ConnectStart: func(_, _ string) {
+			t.connStart = time.Now()
+		},
+		ConnectDone: func(_, _ string, _ error) {
+			t.connDone = time.Now()
+		},
+		TLSHandshakeStart: func() {
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, _ error) {
+			t.tlsDone = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			t.firstByte = time.Now()
+		},
+	}
+}
+
+// Durations gives, in milliseconds, the time spent by each step of the
+// request. Steps that did not happen (eg: connection reused) are zero.
+func (t *timing) Durations() map[string]float64 {
+	since := func(from, to time.Time) float64 {
+		if from.IsZero() || to.IsZero() {
+			return 0
+		}
+		return float64(to.Sub(from)) / float64(time.Millisecond)
+	}
+	return map[string]float64{
+		"dns":       since(t.dnsStart, t.dnsDone),
+		"connect":   since(t.connStart, t.connDone),
+		"tls":       since(t.tlsStart, t.tlsDone),
+		"firstByte": since(t.start, t.firstByte),
+		"total":     since(t.start, t.done),
+	}
+}
+
 type Body interface {
-	Open() (io.ReadCloser, error)
+	Open(env.Environ[string]) (io.ReadCloser, error)
 }
 
 func PrepareBody(str string) (Body, error) {
@@ -249,17 +671,125 @@ func PrepareBody(str string) (Body, error) {
 
 type stringBody string
 
-func (b stringBody) Open() (io.ReadCloser, error) {
+func (b stringBody) Open(_ env.Environ[string]) (io.ReadCloser, error) {
 	r := strings.NewReader(string(b))
 	return io.NopCloser(r), nil
 }
 
 type fileBody string
 
-func (b fileBody) Open() (io.ReadCloser, error) {
+func (b fileBody) Open(_ env.Environ[string]) (io.ReadCloser, error) {
 	return os.Open(string(b))
 }
 
+type graphqlBody struct {
+	query     Word
+	operation Word
+	variables Bag
+}
+
+func (b graphqlBody) Open(ev env.Environ[string]) (io.ReadCloser, error) {
+	var (
+		envelope struct {
+			Query     string         `json:"query"`
+			Variables map[string]any `json:"variables,omitempty"`
+			Operation string         `json:"operationName,omitempty"`
+		}
+		err error
+	)
+	if envelope.Query, err = b.query.Expand(ev); err != nil {
+		return nil, err
+	}
+	if b.operation != nil {
+		if envelope.Operation, err = b.operation.Expand(ev); err != nil {
+			return nil, err
+		}
+	}
+	if b.variables != nil {
+		vs, err := b.variables.Values(ev)
+		if err != nil {
+			return nil, err
+		}
+		envelope.Variables = make(map[string]any)
+		for k := range vs {
+			if len(vs[k]) == 1 {
+				envelope.Variables[k] = graphqlValue(vs[k][0])
+				continue
+			}
+			list := make([]any, 0, len(vs[k]))
+			for _, v := range vs[k] {
+				list = append(list, graphqlValue(v))
+			}
+			envelope.Variables[k] = list
+		}
+	}
+	buf, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(buf)), nil
+}
+
+func (b graphqlBody) ContentType() string {
+	return "application/json"
+}
+
+// graphqlValue decodes the expanded value of a variable as JSON to keep its
+// type in the envelope. Values that are not valid JSON are given as strings.
+func graphqlValue(str string) any {
+	if !json.Valid([]byte(str)) {
+		return str
+	}
+	var (
+		val any
+		dec = json.NewDecoder(strings.NewReader(str))
+	)
+	dec.UseNumber()
+	if err := dec.Decode(&val); err != nil {
+		return str
+	}
+	return val
+}
+
+// decompress replaces the content of body by its decoded content when the
+// response has a Content-Encoding set to gzip or deflate. brotli is not
+// supported and the body is kept as is.
+func decompress(res *http.Response, body *bytes.Buffer) error {
+	var (
+		encoding = strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding")))
+		rs       io.ReadCloser
+		err      error
+	)
+	switch encoding {
+	case "gzip", "x-gzip":
+		rs, err = gzip.NewReader(bytes.NewReader(body.Bytes()))
+	case "deflate":
+		rs, err = zlib.NewReader(bytes.NewReader(body.Bytes()))
+		if err != nil {
+			rs, err = flate.NewReader(bytes.NewReader(body.Bytes())), nil
+		}
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: fail to decode response body: %w", encoding, err)
+	}
+	defer rs.Close()
+
+	buf, err := io.ReadAll(rs)
+	if err != nil {
+		return fmt.Errorf("%s: fail to decode response body: %w", encoding, err)
+	}
+	body.Reset()
+	body.Write(buf)
+
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = int64(len(buf))
+	res.Uncompressed = true
+	return nil
+}
+
 type ExpectFunc func(*http.Response) error
 
 func expectNothing(_ *http.Response) error {
@@ -278,6 +808,15 @@ func expectCode(code int) (ExpectFunc, error) {
 	}, nil
 }
 
+func isCodeRange(ident string) bool {
+	switch ident {
+	case "info", "success", "redirect", "bad-request", "server-error":
+		return true
+	default:
+		return false
+	}
+}
+
 func expectCodeRange(ident string) (ExpectFunc, error) {
 	var fc, tc int
 	switch ident {
@@ -292,7 +831,7 @@ func expectCodeRange(ident string) (ExpectFunc, error) {
 	case "server-error":
 		fc, tc = 500, 599
 	default:
-		return nil, fmt.Errorf("%s: not recognized")
+		return nil, fmt.Errorf("%s: not recognized", ident)
 	}
 	return func(r *http.Response) error {
 		if r.StatusCode >= fc && r.StatusCode <= tc {
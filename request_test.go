@@ -0,0 +1,650 @@
+package mule
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/midbel/enjoy/env"
+	"github.com/midbel/enjoy/value"
+)
+
+func TestRequestMethod(t *testing.T) {
+	ctx, err := MuleContext(Empty(""))
+	if err != nil {
+		t.Fatalf("unexpected error creating context: %s", err)
+	}
+	tests := []struct {
+		Method string
+		Want   string
+	}{
+		{Method: "get", Want: "GET"},
+		{Method: "post", Want: "POST"},
+		{Method: "put", Want: "PUT"},
+		{Method: "delete", Want: "DELETE"},
+		{Method: "patch", Want: "PATCH"},
+		{Method: "head", Want: "HEAD"},
+	}
+	for _, tt := range tests {
+		r := Prepare("test", tt.Method)
+		r.location = createLiteral("http://localhost/test")
+		req, err := r.Prepare(ctx)
+		if err != nil {
+			t.Errorf("%s: unexpected error preparing request: %s", tt.Method, err)
+			continue
+		}
+		if req.Method != tt.Want {
+			t.Errorf("%s: method mismatched! want %s, got %s", tt.Method, tt.Want, req.Method)
+		}
+	}
+}
+
+func TestGraphqlBody(t *testing.T) {
+	vars := Standard()
+	vars.Add("limit", createLiteral("100"))
+	vars.Add("draft", createLiteral("true"))
+	vars.Add("name", createLiteral("foo"))
+	vars.Add("filter", createLiteral(`{"age": 42}`))
+	vars.Add("tags", createLiteral("bar"))
+	vars.Add("tags", createLiteral("1"))
+	vars.Add("user", createVariable("user"))
+
+	ev := env.EmptyEnv[string]()
+	ev.Define("user", "42", false)
+
+	body := graphqlBody{
+		query:     createLiteral("query { users }"),
+		operation: createLiteral("users"),
+		variables: vars,
+	}
+	r, err := body.Open(ev)
+	if err != nil {
+		t.Fatalf("unexpected error opening body: %s", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error reading body: %s", err)
+	}
+	want := `{"query":"query { users }","variables":{"draft":true,"filter":{"age":42},"limit":100,"name":"foo","tags":["bar",1],"user":42},"operationName":"users"}`
+	if string(got) != want {
+		t.Errorf("body mismatched!\nwant: %s\ngot:  %s", want, got)
+	}
+}
+
+// notifyWriter signals the first write made to it.
+type notifyWriter struct {
+	once   sync.Once
+	notify chan struct{}
+	size   int
+}
+
+func (w *notifyWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.notify)
+	})
+	w.size += len(b)
+	return len(b), nil
+}
+
+func TestRequestStream(t *testing.T) {
+	const size = 1 << 20
+	var (
+		out = notifyWriter{
+			notify: make(chan struct{}),
+		}
+		chunk = strings.Repeat("x", size)
+	)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, chunk)
+		w.(http.Flusher).Flush()
+		select {
+		case <-out.notify:
+		case <-time.After(5 * time.Second):
+			t.Errorf("body buffered before being written to the output")
+		}
+		io.WriteString(w, chunk)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(handler))
+	defer srv.Close()
+
+	c, err := parseString(fmt.Sprintf("get test {\n\turl %q\n\tstream true\n}\n", srv.URL))
+	if err != nil {
+		t.Fatalf("unexpected error parsing collection: %s", err)
+	}
+	if err := c.Run("test", &out); err != nil {
+		t.Fatalf("unexpected error running request: %s", err)
+	}
+	if out.size != 2*size {
+		t.Errorf("body size mismatched! want %d, got %d", 2*size, out.size)
+	}
+}
+
+func TestRequestOutput(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"name": "mule"}`)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	src := fmt.Sprintf("get test {\n\turl %q\n\toutput \"responses/${requestName}.json\"\n}\n", srv.URL)
+	file := filepath.Join(dir, "sample.mu")
+	if err := os.WriteFile(file, []byte(src), 0o644); err != nil {
+		t.Fatalf("unexpected error writing collection: %s", err)
+	}
+	c, err := Open(file)
+	if err != nil {
+		t.Fatalf("unexpected error parsing collection: %s", err)
+	}
+	var out strings.Builder
+	if err := c.Run("test", &out); err != nil {
+		t.Fatalf("unexpected error running request: %s", err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "responses", "test.json"))
+	if err != nil {
+		t.Fatalf("output not written next to the collection: %s", err)
+	}
+	if want := `{"name": "mule"}`; string(got) != want || out.String() != want {
+		t.Errorf("body mismatched! want %s, got %s (output: %s)", want, got, out.String())
+	}
+}
+
+func TestTiming(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(10 * time.Millisecond)
+		io.WriteString(w, "done")
+	}))
+	defer srv.Close()
+
+	var trace timing
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating request: %s", err)
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.Trace()))
+
+	trace.start = time.Now()
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error sending request: %s", err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	trace.done = time.Now()
+
+	ds := trace.Durations()
+	for _, k := range []string{"dns", "connect", "tls", "firstByte", "total"} {
+		v, ok := ds[k]
+		if !ok {
+			t.Errorf("%s: timing missing", k)
+			continue
+		}
+		if v < 0 {
+			t.Errorf("%s: negative timing %f", k, v)
+		}
+	}
+	for _, k := range []string{"connect", "tls", "firstByte"} {
+		if ds[k] == 0 {
+			t.Errorf("%s: timing not recorded", k)
+		}
+	}
+	if ds["total"] < ds["firstByte"] {
+		t.Errorf("total should not be less than first byte! total %f, first byte %f", ds["total"], ds["firstByte"])
+	}
+	if ds["total"] < 10 {
+		t.Errorf("total should include the reading of the body! got %f", ds["total"])
+	}
+}
+
+func TestRequestCurl(t *testing.T) {
+	ctx, err := MuleContext(Empty(""))
+	if err != nil {
+		t.Fatalf("unexpected error creating context: %s", err)
+	}
+	create := func(method, body string, headers ...string) Request {
+		r := Prepare("test", method)
+		r.location = createLiteral("http://localhost/users?limit=10")
+		for i := 0; i < len(headers); i += 2 {
+			r.headers.Add(headers[i], createLiteral(headers[i+1]))
+		}
+		if body != "" {
+			r.body = stringBody(body)
+		}
+		return r
+	}
+	auth := create("delete", "")
+	auth.user = createLiteral("foo")
+	auth.pass = createLiteral("bar")
+
+	tests := []struct {
+		Name    string
+		Request Request
+		Want    string
+	}{
+		{
+			Name:    "get",
+			Request: create("get", ""),
+			Want:    `curl -X GET 'http://localhost/users?limit=10'`,
+		},
+		{
+			Name:    "headers",
+			Request: create("get", "", "x-request-id", "42", "accept", "text/plain", "accept", "application/json"),
+			Want:    `curl -X GET 'http://localhost/users?limit=10' -H 'Accept: text/plain' -H 'Accept: application/json' -H 'X-Request-Id: 42'`,
+		},
+		{
+			Name:    "body",
+			Request: create("post", `{"name": "it's mule"}`, "content-type", "application/json"),
+			Want:    `curl -X POST 'http://localhost/users?limit=10' -H 'Content-Type: application/json' --data-binary '{"name": "it'\''s mule"}'`,
+		},
+		{
+			Name:    "auth",
+			Request: auth,
+			Want:    `curl -X DELETE 'http://localhost/users?limit=10' -H 'Authorization: Basic Zm9vOmJhcg=='`,
+		},
+		{
+			Name:    "quoted-header",
+			Request: create("patch", "", "x-name", "O'Reilly"),
+			Want:    `curl -X PATCH 'http://localhost/users?limit=10' -H 'X-Name: O'\''Reilly'`,
+		},
+	}
+	for _, tt := range tests {
+		var out strings.Builder
+		if err := tt.Request.Curl(ctx, &out); err != nil {
+			t.Errorf("%s: unexpected error writing curl command: %s", tt.Name, err)
+			continue
+		}
+		if got := strings.TrimSpace(out.String()); got != tt.Want {
+			t.Errorf("%s: command mismatched!\nwant: %s\ngot:  %s", tt.Name, tt.Want, got)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		Input string
+		Want  string
+	}{
+		{Input: "", Want: `''`},
+		{Input: "foo bar", Want: `'foo bar'`},
+		{Input: "it's", Want: `'it'\''s'`},
+		{Input: `"$HOME" $(id)`, Want: `'"$HOME" $(id)'`},
+		{Input: "''", Want: `''\'''\'''`},
+	}
+	for _, tt := range tests {
+		if got := shellQuote(tt.Input); got != tt.Want {
+			t.Errorf("%s: quoted string mismatched! want %s, got %s", tt.Input, tt.Want, got)
+		}
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	const body = `{"name": "mule", "tags": ["http", "client"]}`
+	compress := func(create func(io.Writer) io.WriteCloser) []byte {
+		var buf bytes.Buffer
+		w := create(&buf)
+		io.WriteString(w, body)
+		w.Close()
+		return buf.Bytes()
+	}
+	tests := []struct {
+		Encoding string
+		Body     []byte
+		Want     string
+		Decoded  bool
+		Fail     bool
+	}{
+		{
+			Encoding: "gzip",
+			Body: compress(func(w io.Writer) io.WriteCloser {
+				return gzip.NewWriter(w)
+			}),
+			Want:    body,
+			Decoded: true,
+		},
+		{
+			Encoding: "x-gzip",
+			Body: compress(func(w io.Writer) io.WriteCloser {
+				return gzip.NewWriter(w)
+			}),
+			Want:    body,
+			Decoded: true,
+		},
+		{
+			Encoding: "deflate",
+			Body: compress(func(w io.Writer) io.WriteCloser {
+				return zlib.NewWriter(w)
+			}),
+			Want:    body,
+			Decoded: true,
+		},
+		{
+			Encoding: "Deflate",
+			Body: compress(func(w io.Writer) io.WriteCloser {
+				fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+				return fw
+			}),
+			Want:    body,
+			Decoded: true,
+		},
+		{
+			Encoding: "br",
+			Body:     []byte("brotli"),
+			Want:     "brotli",
+		},
+		{
+			Body: []byte(body),
+			Want: body,
+		},
+		{
+			Encoding: "gzip",
+			Body:     []byte(body),
+			Fail:     true,
+		},
+	}
+	for _, tt := range tests {
+		res := http.Response{
+			Header:        http.Header{},
+			ContentLength: int64(len(tt.Body)),
+		}
+		if tt.Encoding != "" {
+			res.Header.Set("Content-Encoding", tt.Encoding)
+		}
+		res.Header.Set("Content-Length", strconv.Itoa(len(tt.Body)))
+
+		buf := bytes.NewBuffer(tt.Body)
+		err := decompress(&res, buf)
+		if tt.Fail {
+			if err == nil {
+				t.Errorf("%s: expected error but body decoded", tt.Encoding)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error decoding body: %s", tt.Encoding, err)
+			continue
+		}
+		if buf.String() != tt.Want {
+			t.Errorf("%s: body mismatched! want %s, got %s", tt.Encoding, tt.Want, buf.String())
+		}
+		if got := res.Header.Get("Content-Encoding"); tt.Decoded && got != "" {
+			t.Errorf("%s: Content-Encoding should have been removed! got %s", tt.Encoding, got)
+		} else if !tt.Decoded && got != tt.Encoding {
+			t.Errorf("%s: Content-Encoding should have been kept! got %s", tt.Encoding, got)
+		}
+		if res.ContentLength != int64(len(tt.Want)) || res.Uncompressed != tt.Decoded {
+			t.Errorf("%s: content length mismatched! want %d, got %d", tt.Encoding, len(tt.Want), res.ContentLength)
+		}
+		if got := res.Header.Get("Content-Length"); tt.Decoded && got != "" {
+			t.Errorf("%s: Content-Length should have been removed! got %s", tt.Encoding, got)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, "http://localhost/login?next=%2Fhome", nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating request: %s", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+	req.Header.Add("Cookie", "session=foobar")
+
+	res := http.Response{
+		Proto:  "HTTP/1.1",
+		Status: "200 OK",
+		Header: http.Header{},
+	}
+	res.Header.Set("Content-Type", "application/json")
+	res.Header.Add("Set-Cookie", "session=foobar; Path=/")
+	res.Header.Add("Set-Cookie", "lang=en")
+
+	tests := []struct {
+		Secrets bool
+		Want    string
+	}{
+		{
+			Secrets: false,
+			Want: `> POST http://localhost/login?next=%2Fhome HTTP/1.1
+> Accept: application/json
+> Authorization: [redacted]
+> Cookie: [redacted]
+>
+< HTTP/1.1 200 OK
+< Content-Type: application/json
+< Set-Cookie: [redacted]
+< Set-Cookie: [redacted]
+<
+`,
+		},
+		{
+			Secrets: true,
+			Want: `> POST http://localhost/login?next=%2Fhome HTTP/1.1
+> Accept: application/json
+> Authorization: Basic Zm9vOmJhcg==
+> Cookie: session=foobar
+>
+< HTTP/1.1 200 OK
+< Content-Type: application/json
+< Set-Cookie: session=foobar; Path=/
+< Set-Cookie: lang=en
+<
+`,
+		},
+	}
+	for _, tt := range tests {
+		var (
+			out strings.Builder
+			log = logger{
+				w:       &out,
+				secrets: tt.Secrets,
+			}
+		)
+		log.Request(req)
+		log.Response(&res)
+		if got := out.String(); got != tt.Want {
+			t.Errorf("secrets %t: output mismatched!\nwant:\n%s\ngot:\n%s", tt.Secrets, tt.Want, got)
+		}
+	}
+
+	var log *logger
+	log.Request(req)
+	log.Response(&res)
+}
+
+func TestRunVerbose(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "foobar"})
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	src := fmt.Sprintf("get test {\n\turl %q\n\tusername foo\n\tpassword bar\n}\n", srv.URL)
+	for _, secrets := range []bool{false, true} {
+		c, err := parseString(src)
+		if err != nil {
+			t.Fatalf("unexpected error parsing collection: %s", err)
+		}
+		var out strings.Builder
+		c.Verbose(&out, secrets)
+		if err := c.Run("test", io.Discard); err != nil {
+			t.Fatalf("unexpected error running request: %s", err)
+		}
+		wants := []string{
+			fmt.Sprintf("> GET %s HTTP/1.1\n", srv.URL),
+			"< HTTP/1.1 200 OK\n",
+			"< Content-Length: 2\n",
+		}
+		if secrets {
+			wants = append(wants, "> Authorization: Basic Zm9vOmJhcg==\n", "< Set-Cookie: session=foobar\n")
+		} else {
+			wants = append(wants, "> Authorization: [redacted]\n", "< Set-Cookie: [redacted]\n")
+		}
+		for _, w := range wants {
+			if !strings.Contains(out.String(), w) {
+				t.Errorf("secrets %t: %q not found in output\n%s", secrets, w, out.String())
+			}
+		}
+	}
+}
+
+func TestCollectionHeaders(t *testing.T) {
+	src := `
+default headers {
+	user-agent mule
+	accept     '*/*'
+}
+force headers {
+	x-client mule
+	x-trace  root
+}
+collection api {
+	default headers {
+		user-agent api
+	}
+	force headers {
+		x-trace api
+	}
+	get list {
+		url 'http://localhost/list'
+		headers {
+			accept     'application/json'
+			user-agent curl
+			x-client   custom
+		}
+	}
+	get plain {
+		url 'http://localhost/plain'
+	}
+}
+`
+	c, err := parseString(src)
+	if err != nil {
+		t.Fatalf("unexpected error parsing collection: %s", err)
+	}
+	sub, err := c.GetCollection("api")
+	if err != nil {
+		t.Fatalf("api: collection not found")
+	}
+	ctx, err := MuleContext(sub)
+	if err != nil {
+		t.Fatalf("unexpected error creating context: %s", err)
+	}
+	tests := []struct {
+		Name string
+		Want http.Header
+	}{
+		{
+			Name: "list",
+			Want: http.Header{
+				"Accept":     []string{"application/json"},
+				"User-Agent": []string{"curl"},
+				"X-Client":   []string{"mule"},
+				"X-Trace":    []string{"api"},
+			},
+		},
+		{
+			Name: "plain",
+			Want: http.Header{
+				"Accept":     []string{"*/*"},
+				"User-Agent": []string{"api"},
+				"X-Client":   []string{"mule"},
+				"X-Trace":    []string{"api"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		q, err := sub.GetRequest(tt.Name)
+		if err != nil {
+			t.Fatalf("%s: request not found", tt.Name)
+		}
+		req, err := q.Prepare(ctx)
+		if err != nil {
+			t.Errorf("%s: unexpected error preparing request: %s", tt.Name, err)
+			continue
+		}
+		if !reflect.DeepEqual(req.Header, tt.Want) {
+			t.Errorf("%s: headers mismatched! want %v, got %v", tt.Name, tt.Want, req.Header)
+		}
+	}
+}
+
+func TestRequestScriptsOrder(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	src := `
+url %q
+collection users {
+	get list {
+		url '/users'
+	}
+}
+`
+	c, err := parseString(fmt.Sprintf(src, srv.URL))
+	if err != nil {
+		t.Fatalf("unexpected error parsing collection: %s", err)
+	}
+	sub, err := c.GetCollection("users")
+	if err != nil {
+		t.Fatalf("users: collection not found")
+	}
+	var got []string
+	trace := func(label string) value.Evaluable {
+		return scriptFunc(func(ctx *Context, _ env.Environ[value.Value]) error {
+			str, _ := ctx.vars.Resolve("trace")
+			str = strings.TrimSpace(str + " " + label)
+			args := []value.Value{
+				value.CreateString("trace"),
+				value.CreateString(str),
+			}
+			if _, err := ctx.vars.Call("set", args); err != nil {
+				return err
+			}
+			got = strings.Fields(str)
+			return nil
+		})
+	}
+	c.before = append(c.before, trace("root.before"))
+	c.after = append(c.after, trace("root.after"))
+	sub.before = append(sub.before, trace("users.before"))
+	sub.after = append(sub.after, trace("users.after"))
+	sub.beforeEach = append(sub.beforeEach, trace("users.beforeEach"))
+	sub.afterEach = append(sub.afterEach, trace("users.afterEach"))
+	q := findRequest(t, sub, "list")
+	q.before = trace("list.before")
+	q.after = trace("list.after")
+
+	if err := c.Run("users.list", io.Discard); err != nil {
+		t.Fatalf("unexpected error running request: %s", err)
+	}
+	want := []string{
+		"root.before",
+		"users.before",
+		"users.beforeEach",
+		"list.before",
+		"users.afterEach",
+		"list.after",
+		"users.after",
+		"root.after",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("scripts order mismatched!\nwant: %s\ngot:  %s", want, got)
+	}
+}
@@ -15,9 +15,15 @@ var keywords = []string{
 	"password",
 	"collection",
 	"variables",
+	"environment",
 	"headers",
 	"tls",
+	"transport",
+	"proxy",
+	"noproxy",
+	"rate",
 	"default",
+	"force",
 	"query",
 	"cookie",
 	"before",
@@ -35,6 +41,7 @@ var keywords = []string{
 	"patch",
 	"head",
 	"option",
+	"trace",
 }
 
 func isSpecial(str string) bool {
@@ -240,6 +247,9 @@ func (s *Scanner) scanHeredoc(tok *Token) {
 		if len(line) == 0 {
 			continue
 		}
+		if body.Len() > 0 {
+			body.WriteRune(nl)
+		}
 		body.WriteString(line)
 	}
 	tok.Type = String
@@ -267,21 +277,27 @@ func (s *Scanner) scanComment(tok *Token) {
 
 func (s *Scanner) scanVariable(tok *Token) {
 	s.read()
-	var brace bool
-	if brace = s.char == lbrace; brace {
-		s.read()
-	}
-	s.scanIdent(tok)
-	if tok.Type != Ident {
-		tok.Type = Invalid
+	if s.char != lbrace {
+		s.scanIdent(tok)
+		if tok.Type != Ident {
+			tok.Type = Invalid
+			return
+		}
+		tok.Type = Variable
 		return
 	}
+	s.read()
+	for !s.done() && s.char != rbrace && !isNL(s.char) {
+		s.write()
+		s.read()
+	}
+	tok.Literal = s.literal()
 	tok.Type = Variable
-	if brace && s.char != rbrace {
+	if s.char != rbrace || tok.Literal == "" {
 		tok.Type = Invalid
-	} else if brace {
-		s.read()
+		return
 	}
+	s.read()
 }
 
 func (s *Scanner) scanMacro(tok *Token) {
@@ -0,0 +1,387 @@
+package mule
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema validates JSON documents against a subset of JSON Schema: type,
+// enum, const, the numeric, string, array and object constraints, the
+// combinators allOf/anyOf/oneOf/not and the local references ($ref starting
+// with #).
+type jsonSchema struct {
+	source string
+	root   any
+}
+
+func compileSchema(str string) (*jsonSchema, error) {
+	s := jsonSchema{
+		source: str,
+	}
+	if err := json.Unmarshal([]byte(str), &s.root); err != nil {
+		return nil, fmt.Errorf("schema: %w", err)
+	}
+	switch s.root.(type) {
+	case map[string]any, bool:
+	default:
+		return nil, fmt.Errorf("schema: object or boolean expected")
+	}
+	return &s, nil
+}
+
+// Validate decodes body as JSON and checks it against the schema. The first
+// violation found is returned.
+func (s *jsonSchema) Validate(body []byte) error {
+	var (
+		doc any
+		dec = json.NewDecoder(bytes.NewReader(body))
+	)
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("schema: invalid json body: %w", err)
+	}
+	return s.validate(s.root, doc, "$", 0)
+}
+
+func (s *jsonSchema) validate(schema, doc any, path string, depth int) error {
+	if depth > 64 {
+		return fmt.Errorf("%s: schema nested too deeply", path)
+	}
+	var rules map[string]any
+	switch v := schema.(type) {
+	case bool:
+		if !v {
+			return fmt.Errorf("%s: value not allowed", path)
+		}
+		return nil
+	case map[string]any:
+		rules = v
+	default:
+		return nil
+	}
+	if ref, ok := rules["$ref"].(string); ok {
+		other, err := s.resolve(ref)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return s.validate(other, doc, path, depth+1)
+	}
+	if err := checkType(rules["type"], doc, path); err != nil {
+		return err
+	}
+	if list, ok := rules["enum"].([]any); ok {
+		if !slicesContainsJSON(list, doc) {
+			return fmt.Errorf("%s: value is not one of the allowed values", path)
+		}
+	}
+	if c, ok := rules["const"]; ok && !equalJSON(c, doc) {
+		return fmt.Errorf("%s: value does not match the expected constant", path)
+	}
+	var err error
+	switch v := doc.(type) {
+	case json.Number:
+		err = checkNumber(rules, v, path)
+	case string:
+		err = checkString(rules, v, path)
+	case []any:
+		err = s.checkArray(rules, v, path, depth)
+	case map[string]any:
+		err = s.checkObject(rules, v, path, depth)
+	}
+	if err != nil {
+		return err
+	}
+	return s.checkCombinators(rules, doc, path, depth)
+}
+
+func (s *jsonSchema) checkCombinators(rules map[string]any, doc any, path string, depth int) error {
+	if list, ok := rules["allOf"].([]any); ok {
+		for _, sub := range list {
+			if err := s.validate(sub, doc, path, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	if list, ok := rules["anyOf"].([]any); ok {
+		var valid bool
+		for _, sub := range list {
+			if s.validate(sub, doc, path, depth+1) == nil {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("%s: value does not match any of the schemas", path)
+		}
+	}
+	if list, ok := rules["oneOf"].([]any); ok {
+		var count int
+		for _, sub := range list {
+			if s.validate(sub, doc, path, depth+1) == nil {
+				count++
+			}
+		}
+		if count != 1 {
+			return fmt.Errorf("%s: value matches %d schemas instead of exactly one", path, count)
+		}
+	}
+	if sub, ok := rules["not"]; ok {
+		if s.validate(sub, doc, path, depth+1) == nil {
+			return fmt.Errorf("%s: value matches a forbidden schema", path)
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) checkObject(rules map[string]any, doc map[string]any, path string, depth int) error {
+	if list, ok := rules["required"].([]any); ok {
+		for _, r := range list {
+			key, _ := r.(string)
+			if _, ok := doc[key]; !ok {
+				return fmt.Errorf("%s: required property missing", joinPath(path, key))
+			}
+		}
+	}
+	if n, ok := schemaInt(rules, "minProperties"); ok && len(doc) < n {
+		return fmt.Errorf("%s: at least %d properties expected", path, n)
+	}
+	if n, ok := schemaInt(rules, "maxProperties"); ok && len(doc) > n {
+		return fmt.Errorf("%s: at most %d properties expected", path, n)
+	}
+	props, _ := rules["properties"].(map[string]any)
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		sub, ok := props[k]
+		if !ok {
+			sub, ok = rules["additionalProperties"]
+		}
+		if !ok {
+			continue
+		}
+		if b, ok := sub.(bool); ok && !b {
+			return fmt.Errorf("%s: additional property not allowed", joinPath(path, k))
+		}
+		if err := s.validate(sub, doc[k], joinPath(path, k), depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) checkArray(rules map[string]any, doc []any, path string, depth int) error {
+	if n, ok := schemaInt(rules, "minItems"); ok && len(doc) < n {
+		return fmt.Errorf("%s: at least %d items expected", path, n)
+	}
+	if n, ok := schemaInt(rules, "maxItems"); ok && len(doc) > n {
+		return fmt.Errorf("%s: at most %d items expected", path, n)
+	}
+	if unique, _ := rules["uniqueItems"].(bool); unique {
+		for i := range doc {
+			if slicesContainsJSON(doc[:i], doc[i]) {
+				return fmt.Errorf("%s[%d]: duplicate item", path, i)
+			}
+		}
+	}
+	if sub, ok := rules["items"]; ok {
+		for i := range doc {
+			if err := s.validate(sub, doc[i], fmt.Sprintf("%s[%d]", path, i), depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkString(rules map[string]any, str, path string) error {
+	size := utf8.RuneCountInString(str)
+	if n, ok := schemaInt(rules, "minLength"); ok && size < n {
+		return fmt.Errorf("%s: at least %d characters expected", path, n)
+	}
+	if n, ok := schemaInt(rules, "maxLength"); ok && size > n {
+		return fmt.Errorf("%s: at most %d characters expected", path, n)
+	}
+	if pattern, ok := rules["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid pattern: %w", path, err)
+		}
+		if !re.MatchString(str) {
+			return fmt.Errorf("%s: value does not match pattern %s", path, pattern)
+		}
+	}
+	return nil
+}
+
+func checkNumber(rules map[string]any, num json.Number, path string) error {
+	val, err := num.Float64()
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	limit := func(key string) (float64, bool) {
+		f, ok := rules[key].(float64)
+		return f, ok
+	}
+	if f, ok := limit("minimum"); ok && val < f {
+		return fmt.Errorf("%s: value lower than %v", path, f)
+	}
+	if f, ok := limit("maximum"); ok && val > f {
+		return fmt.Errorf("%s: value greater than %v", path, f)
+	}
+	if f, ok := limit("exclusiveMinimum"); ok && val <= f {
+		return fmt.Errorf("%s: value lower or equal to %v", path, f)
+	}
+	if f, ok := limit("exclusiveMaximum"); ok && val >= f {
+		return fmt.Errorf("%s: value greater or equal to %v", path, f)
+	}
+	if f, ok := limit("multipleOf"); ok && f > 0 {
+		if q := val / f; q != math.Trunc(q) {
+			return fmt.Errorf("%s: value not a multiple of %v", path, f)
+		}
+	}
+	return nil
+}
+
+func checkType(kind, doc any, path string) error {
+	var list []string
+	switch k := kind.(type) {
+	case string:
+		list = append(list, k)
+	case []any:
+		for _, v := range k {
+			if s, ok := v.(string); ok {
+				list = append(list, s)
+			}
+		}
+	default:
+		return nil
+	}
+	for _, k := range list {
+		if isType(k, doc) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(list, " or "), typeOf(doc))
+}
+
+func isType(kind string, doc any) bool {
+	switch kind {
+	case "integer":
+		n, ok := doc.(json.Number)
+		if !ok {
+			return false
+		}
+		f, err := n.Float64()
+		return err == nil && f == math.Trunc(f)
+	default:
+		return typeOf(doc) == kind
+	}
+}
+
+func typeOf(doc any) string {
+	switch doc.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return "unknown"
+	}
+}
+
+func (s *jsonSchema) resolve(ref string) (any, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("%s: only local references are supported", ref)
+	}
+	var curr = s.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.ReplaceAll(part, "~1", "/")
+		part = strings.ReplaceAll(part, "~0", "~")
+		obj, ok := curr.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: reference not found", ref)
+		}
+		if curr, ok = obj[part]; !ok {
+			return nil, fmt.Errorf("%s: reference not found", ref)
+		}
+	}
+	return curr, nil
+}
+
+func schemaInt(rules map[string]any, key string) (int, bool) {
+	f, ok := rules[key].(float64)
+	return int(f), ok
+}
+
+func joinPath(path, key string) string {
+	return path + "." + key
+}
+
+// equalJSON compares a value coming from the schema with a value coming from
+// the document. Numbers of the document are kept as json.Number.
+func equalJSON(want, got any) bool {
+	if n, ok := want.(json.Number); ok {
+		want, _ = n.Float64()
+	}
+	if n, ok := got.(json.Number); ok {
+		f, err := n.Float64()
+		w, ok := want.(float64)
+		return err == nil && ok && f == w
+	}
+	switch g := got.(type) {
+	case []any:
+		w, ok := want.([]any)
+		if !ok || len(w) != len(g) {
+			return false
+		}
+		for i := range g {
+			if !equalJSON(w[i], g[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		w, ok := want.(map[string]any)
+		if !ok || len(w) != len(g) {
+			return false
+		}
+		for k := range g {
+			if !equalJSON(w[k], g[k]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(want, got)
+	}
+}
+
+func slicesContainsJSON(list []any, doc any) bool {
+	for _, v := range list {
+		if equalJSON(v, doc) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package mule
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompileSchema(t *testing.T) {
+	tests := []struct {
+		Schema string
+		Fail   bool
+	}{
+		{Schema: `{}`},
+		{Schema: `true`},
+		{Schema: `false`},
+		{Schema: `{"type": "object", "properties": {"name": {"type": "string"}}}`},
+		{Schema: `[]`, Fail: true},
+		{Schema: `"string"`, Fail: true},
+		{Schema: `{"type": `, Fail: true},
+	}
+	for _, tt := range tests {
+		s, err := compileSchema(tt.Schema)
+		if tt.Fail {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.Schema)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.Schema, err)
+			continue
+		}
+		if s.source != tt.Schema {
+			t.Errorf("%s: source mismatched! got %s", tt.Schema, s.source)
+		}
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	const schema = `{
+		"type": "object",
+		"required": ["id", "name"],
+		"additionalProperties": false,
+		"properties": {
+			"id": {"type": "integer", "minimum": 1},
+			"name": {"type": "string", "minLength": 2, "maxLength": 8, "pattern": "^[a-z]+$"},
+			"price": {"type": "number", "exclusiveMinimum": 0, "multipleOf": 0.5},
+			"status": {"enum": ["available", "sold"]},
+			"kind": {"const": "pet"},
+			"tags": {"type": "array", "items": {"type": "string"}, "minItems": 1, "uniqueItems": true},
+			"owner": {"$ref": "#/$defs/owner"},
+			"code": {"oneOf": [{"type": "integer"}, {"type": "string", "maxLength": 3}]},
+			"ref": {"anyOf": [{"type": "null"}, {"type": "string"}]},
+			"note": {"not": {"type": "null"}},
+			"extra": {"allOf": [{"type": "object"}, {"required": ["key"]}]}
+		},
+		"$defs": {
+			"owner": {"type": "object", "required": ["email"], "minProperties": 1}
+		}
+	}`
+	s, err := compileSchema(schema)
+	if err != nil {
+		t.Fatalf("unexpected error compiling schema: %s", err)
+	}
+	tests := []struct {
+		Body string
+		Fail bool
+	}{
+		{Body: `{"id": 1, "name": "rex"}`},
+		{Body: `{"id": 1, "name": "rex", "price": 1.5, "status": "sold", "kind": "pet"}`},
+		{Body: `{"id": 1, "name": "rex", "tags": ["a", "b"], "owner": {"email": "a@b"}}`},
+		{Body: `{"id": 1, "name": "rex", "code": 12, "ref": null, "note": "x", "extra": {"key": 1}}`},
+		{Body: `{"id": 1, "name": "rex", "code": "abc"}`},
+		{Body: `{"name": "rex"}`, Fail: true},
+		{Body: `{"id": 1.5, "name": "rex"}`, Fail: true},
+		{Body: `{"id": 0, "name": "rex"}`, Fail: true},
+		{Body: `{"id": 1, "name": "r"}`, Fail: true},
+		{Body: `{"id": 1, "name": "rexrexrex"}`, Fail: true},
+		{Body: `{"id": 1, "name": "Rex"}`, Fail: true},
+		{Body: `{"id": 1, "name": "rex", "price": 0}`, Fail: true},
+		{Body: `{"id": 1, "name": "rex", "price": 1.2}`, Fail: true},
+		{Body: `{"id": 1, "name": "rex", "status": "lost"}`, Fail: true},
+		{Body: `{"id": 1, "name": "rex", "kind": "cat"}`, Fail: true},
+		{Body: `{"id": 1, "name": "rex", "tags": []}`, Fail: true},
+		{Body: `{"id": 1, "name": "rex", "tags": ["a", "a"]}`, Fail: true},
+		{Body: `{"id": 1, "name": "rex", "tags": [1]}`, Fail: true},
+		{Body: `{"id": 1, "name": "rex", "owner": {}}`, Fail: true},
+		{Body: `{"id": 1, "name": "rex", "code": "abcd"}`, Fail: true},
+		{Body: `{"id": 1, "name": "rex", "ref": 1}`, Fail: true},
+		{Body: `{"id": 1, "name": "rex", "note": null}`, Fail: true},
+		{Body: `{"id": 1, "name": "rex", "extra": {}}`, Fail: true},
+		{Body: `{"id": 1, "name": "rex", "color": "red"}`, Fail: true},
+		{Body: `[]`, Fail: true},
+		{Body: `not json`, Fail: true},
+	}
+	for _, tt := range tests {
+		err := s.Validate([]byte(tt.Body))
+		if tt.Fail && err == nil {
+			t.Errorf("%s: expected error", tt.Body)
+		}
+		if !tt.Fail && err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.Body, err)
+		}
+	}
+}
+
+func TestSchemaStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		io.WriteString(w, `{"name": "rex"}`)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		Path   string
+		Stream bool
+		Fail   bool
+	}{
+		{Path: "/pets", Stream: false, Fail: true},
+		{Path: "/pets", Stream: true},
+		{Path: "/fail", Stream: true, Fail: true},
+	}
+	for _, tt := range tests {
+		src := `
+get test {
+	url %q
+	stream %t
+	expect 200
+	expect schema '{"type": "object", "required": ["id"]}'
+}
+`
+		c, err := parseString(fmt.Sprintf(src, srv.URL+tt.Path, tt.Stream))
+		if err != nil {
+			t.Fatalf("unexpected error parsing collection: %s", err)
+		}
+		var out strings.Builder
+		err = c.Run("test", &out)
+		if tt.Fail {
+			if err == nil {
+				t.Errorf("%s (stream %t): expected error but request succeeded", tt.Path, tt.Stream)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s (stream %t): unexpected error running request: %s", tt.Path, tt.Stream, err)
+			continue
+		}
+		if want := `{"name": "rex"}`; out.String() != want {
+			t.Errorf("%s (stream %t): body mismatched! want %s, got %s", tt.Path, tt.Stream, want, out.String())
+		}
+	}
+}
@@ -1,9 +1,20 @@
 package mule
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"net/url"
+	"os"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/midbel/enjoy/env"
 )
@@ -108,3 +119,601 @@ func (v variable) ExpandURL(e env.Environ[string]) (*url.URL, error) {
 	}
 	return url.Parse(str)
 }
+
+// mergedURL resolves a URL relative to a base URL. An absolute URL replaces the
+// base, a relative path is appended to the path of the base and the query
+// strings of both URLs are merged.
+type mergedURL struct {
+	base  Word
+	child Word
+}
+
+func createMergedURL(base, child Word) Word {
+	if base == nil {
+		return child
+	}
+	if child == nil {
+		return base
+	}
+	return mergedURL{
+		base:  base,
+		child: child,
+	}
+}
+
+func (m mergedURL) Expand(ev env.Environ[string]) (string, error) {
+	u, err := m.ExpandURL(ev)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (m mergedURL) ExpandBool(_ env.Environ[string]) (bool, error) {
+	return false, fmt.Errorf("url can not be used as bool")
+}
+
+func (m mergedURL) ExpandInt(_ env.Environ[string]) (int, error) {
+	return 0, fmt.Errorf("url can not be used as int")
+}
+
+func (m mergedURL) ExpandURL(ev env.Environ[string]) (*url.URL, error) {
+	base, err := m.base.ExpandURL(ev)
+	if err != nil {
+		return nil, err
+	}
+	child, err := m.child.ExpandURL(ev)
+	if err != nil {
+		return nil, err
+	}
+	return mergeURL(base, child), nil
+}
+
+func mergeURL(base, child *url.URL) *url.URL {
+	if child.IsAbs() || child.Host != "" {
+		return child
+	}
+	res := *base
+	switch {
+	case child.Path == "":
+	case base.Path == "":
+		res.Path = "/" + strings.TrimPrefix(child.Path, "/")
+	default:
+		res.Path = strings.TrimSuffix(base.Path, "/") + "/" + strings.TrimPrefix(child.Path, "/")
+	}
+	res.RawPath = ""
+	query := base.Query()
+	for k, vs := range child.Query() {
+		query[k] = vs
+	}
+	res.RawQuery = query.Encode()
+	if child.Fragment != "" {
+		res.Fragment = child.Fragment
+	}
+	return &res
+}
+
+type encoded struct {
+	Word
+	macro  string
+	encode func(string) (string, error)
+}
+
+func createEncoded(w Word, macro string, encode func(string) (string, error)) Word {
+	return encoded{
+		Word:   w,
+		macro:  macro,
+		encode: encode,
+	}
+}
+
+func (e encoded) Expand(ev env.Environ[string]) (string, error) {
+	str, err := e.Word.Expand(ev)
+	if err != nil {
+		return "", err
+	}
+	return e.encode(str)
+}
+
+func (e encoded) ExpandBool(ev env.Environ[string]) (bool, error) {
+	str, err := e.Expand(ev)
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(str)
+}
+
+func (e encoded) ExpandInt(ev env.Environ[string]) (int, error) {
+	str, err := e.Expand(ev)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(str)
+}
+
+func (e encoded) ExpandURL(ev env.Environ[string]) (*url.URL, error) {
+	str, err := e.Expand(ev)
+	if err != nil {
+		return nil, err
+	}
+	return url.Parse(str)
+}
+
+func encodeBase64(str string) (string, error) {
+	return base64.StdEncoding.EncodeToString([]byte(str)), nil
+}
+
+func decodeBase64(str string) (string, error) {
+	buf, err := base64.StdEncoding.DecodeString(str)
+	return string(buf), err
+}
+
+func encodeHex(str string) (string, error) {
+	return hex.EncodeToString([]byte(str)), nil
+}
+
+func decodeHex(str string) (string, error) {
+	buf, err := hex.DecodeString(str)
+	return string(buf), err
+}
+
+var (
+	uuidSource io.Reader = rand.Reader
+	timeSource           = time.Now
+)
+
+type environ string
+
+func createEnv(str string) Word {
+	return environ(str)
+}
+
+func (e environ) Expand(_ env.Environ[string]) (string, error) {
+	return os.Getenv(string(e)), nil
+}
+
+func (e environ) ExpandBool(ev env.Environ[string]) (bool, error) {
+	str, err := e.Expand(ev)
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(str)
+}
+
+func (e environ) ExpandInt(ev env.Environ[string]) (int, error) {
+	str, err := e.Expand(ev)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(str)
+}
+
+func (e environ) ExpandURL(ev env.Environ[string]) (*url.URL, error) {
+	str, err := e.Expand(ev)
+	if err != nil {
+		return nil, err
+	}
+	return url.Parse(str)
+}
+
+type uuid struct{}
+
+func createUUID() Word {
+	return uuid{}
+}
+
+// Expand generates a new version 4 UUID each time it is called.
+func (_ uuid) Expand(_ env.Environ[string]) (string, error) {
+	var buf [16]byte
+	if _, err := io.ReadFull(uuidSource, buf[:]); err != nil {
+		return "", err
+	}
+	buf[6] = (buf[6] & 0x0f) | 0x40
+	buf[8] = (buf[8] & 0x3f) | 0x80
+
+	str := hex.EncodeToString(buf[:])
+	return fmt.Sprintf("%s-%s-%s-%s-%s", str[:8], str[8:12], str[12:16], str[16:20], str[20:]), nil
+}
+
+func (u uuid) ExpandBool(_ env.Environ[string]) (bool, error) {
+	return false, fmt.Errorf("uuid can not be used as bool")
+}
+
+func (u uuid) ExpandInt(_ env.Environ[string]) (int, error) {
+	return 0, fmt.Errorf("uuid can not be used as int")
+}
+
+func (u uuid) ExpandURL(ev env.Environ[string]) (*url.URL, error) {
+	str, err := u.Expand(ev)
+	if err != nil {
+		return nil, err
+	}
+	return url.Parse(str)
+}
+
+type timestamp struct {
+	format Word
+}
+
+func createTimestamp(format Word) Word {
+	return timestamp{
+		format: format,
+	}
+}
+
+// Expand gives the current time formatted with the given layout. The layout
+// can be a go time layout or one of rfc3339, unix and unixmilli. rfc3339 is
+// used when no layout is given.
+func (t timestamp) Expand(ev env.Environ[string]) (string, error) {
+	layout := time.RFC3339
+	if t.format != nil {
+		str, err := t.format.Expand(ev)
+		if err != nil {
+			return "", err
+		}
+		layout = str
+	}
+	now := timeSource()
+	switch strings.ToLower(layout) {
+	case "rfc3339":
+		return now.Format(time.RFC3339), nil
+	case "unix":
+		return strconv.FormatInt(now.Unix(), 10), nil
+	case "unixmilli":
+		return strconv.FormatInt(now.UnixMilli(), 10), nil
+	default:
+		return now.Format(layout), nil
+	}
+}
+
+func (t timestamp) ExpandBool(_ env.Environ[string]) (bool, error) {
+	return false, fmt.Errorf("timestamp can not be used as bool")
+}
+
+func (t timestamp) ExpandInt(ev env.Environ[string]) (int, error) {
+	str, err := t.Expand(ev)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(str)
+}
+
+func (t timestamp) ExpandURL(ev env.Environ[string]) (*url.URL, error) {
+	str, err := t.Expand(ev)
+	if err != nil {
+		return nil, err
+	}
+	return url.Parse(str)
+}
+
+// parseVariable creates a Word from the content of a variable. The content can
+// be a plain variable name or a name followed by one of the modifiers
+// supported by parameter expansion in shell.
+func parseVariable(str string) (Word, error) {
+	ix := strings.IndexAny(str, ":#%/^,")
+	if ix < 0 {
+		return createVariable(str), nil
+	}
+	ident, mod := str[:ix], str[ix:]
+	if ident == "" {
+		return nil, fmt.Errorf("%s: variable name is missing", str)
+	}
+	switch {
+	case strings.HasPrefix(mod, ":-"):
+		return createExpansion(str, ident, expandDefault(mod[2:], false)), nil
+	case strings.HasPrefix(mod, ":="):
+		return createExpansion(str, ident, expandDefault(mod[2:], true)), nil
+	case strings.HasPrefix(mod, ":+"):
+		return createExpansion(str, ident, expandAlternate(mod[2:])), nil
+	case strings.HasPrefix(mod, ":?"):
+		return createExpansion(str, ident, expandRequired(mod[2:])), nil
+	case strings.HasPrefix(mod, ":"):
+		fn, err := expandSubstring(mod[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", str, err)
+		}
+		return createExpansion(str, ident, fn), nil
+	case mod == "^" || mod == "^^" || mod == "," || mod == ",,":
+		return createExpansion(str, ident, expandCase(mod)), nil
+	case strings.HasPrefix(mod, "#") || strings.HasPrefix(mod, "%"):
+		fn, err := expandTrim(mod)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", str, err)
+		}
+		return createExpansion(str, ident, fn), nil
+	case strings.HasPrefix(mod, "/"):
+		fn, err := expandReplace(mod[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", str, err)
+		}
+		return createExpansion(str, ident, fn), nil
+	default:
+		return nil, fmt.Errorf("%s: unsupported modifier", str)
+	}
+}
+
+type expandFunc func(env.Environ[string], string, string, error) (string, error)
+
+type expansion struct {
+	source string
+	ident  string
+	expand expandFunc
+}
+
+func createExpansion(source, ident string, fn expandFunc) Word {
+	return expansion{
+		source: source,
+		ident:  ident,
+		expand: fn,
+	}
+}
+
+func (e expansion) Expand(ev env.Environ[string]) (string, error) {
+	str, err := ev.Resolve(e.ident)
+	return e.expand(ev, e.ident, str, err)
+}
+
+func (e expansion) ExpandBool(ev env.Environ[string]) (bool, error) {
+	str, err := e.Expand(ev)
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(str)
+}
+
+func (e expansion) ExpandInt(ev env.Environ[string]) (int, error) {
+	str, err := e.Expand(ev)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(str)
+}
+
+func (e expansion) ExpandURL(ev env.Environ[string]) (*url.URL, error) {
+	str, err := e.Expand(ev)
+	if err != nil {
+		return nil, err
+	}
+	return url.Parse(str)
+}
+
+func expandDefault(value string, assign bool) expandFunc {
+	return func(ev env.Environ[string], ident, str string, err error) (string, error) {
+		if err == nil && str != "" {
+			return str, nil
+		}
+		if assign {
+			if err := ev.Define(ident, value, false); err != nil {
+				return "", err
+			}
+		}
+		return value, nil
+	}
+}
+
+func expandAlternate(value string) expandFunc {
+	return func(_ env.Environ[string], _, str string, err error) (string, error) {
+		if err == nil && str != "" {
+			return value, nil
+		}
+		return "", nil
+	}
+}
+
+func expandRequired(msg string) expandFunc {
+	return func(_ env.Environ[string], ident, str string, err error) (string, error) {
+		if err == nil && str != "" {
+			return str, nil
+		}
+		if msg == "" {
+			msg = "parameter null or not set"
+		}
+		return "", fmt.Errorf("%s: %s", ident, msg)
+	}
+}
+
+// expandSubstring extracts a part of the value of a variable. A negative offset
+// counts from the end of the value. A negative length gives the number of
+// characters to drop at the end of the value.
+func expandSubstring(spec string) (expandFunc, error) {
+	var (
+		offset, length int
+		limit          bool
+		err            error
+	)
+	start, size, ok := strings.Cut(spec, ":")
+	if offset, err = strconv.Atoi(strings.TrimSpace(start)); err != nil {
+		return nil, fmt.Errorf("invalid offset")
+	}
+	if ok {
+		if length, err = strconv.Atoi(strings.TrimSpace(size)); err != nil {
+			return nil, fmt.Errorf("invalid length")
+		}
+		limit = true
+	}
+	fn := func(_ env.Environ[string], _, str string, err error) (string, error) {
+		if err != nil {
+			return "", err
+		}
+		var (
+			chars = []rune(str)
+			beg   = offset
+			end   = len(chars)
+		)
+		if beg < 0 {
+			beg += len(chars)
+		}
+		if beg < 0 || beg > len(chars) {
+			return "", nil
+		}
+		if limit {
+			if length < 0 {
+				end += length
+			} else {
+				end = min(beg+length, end)
+			}
+		}
+		if end <= beg {
+			return "", nil
+		}
+		return string(chars[beg:end]), nil
+	}
+	return fn, nil
+}
+
+func expandCase(mod string) expandFunc {
+	return func(_ env.Environ[string], _, str string, err error) (string, error) {
+		if err != nil || str == "" {
+			return str, err
+		}
+		switch mod {
+		case "^^":
+			return strings.ToUpper(str), nil
+		case ",,":
+			return strings.ToLower(str), nil
+		}
+		char, size := utf8.DecodeRuneInString(str)
+		if mod == "^" {
+			char = unicode.ToUpper(char)
+		} else {
+			char = unicode.ToLower(char)
+		}
+		return string(char) + str[size:], nil
+	}
+}
+
+// expandTrim removes the shortest (# and %) or the longest (## and %%) part of
+// the value matching the given pattern at its start (#) or at its end (%).
+func expandTrim(mod string) (expandFunc, error) {
+	var (
+		prefix  = mod[0] == '#'
+		longest = len(mod) > 1 && mod[1] == mod[0]
+	)
+	if longest {
+		mod = mod[2:]
+	} else {
+		mod = mod[1:]
+	}
+	re, err := compileGlob(mod)
+	if err != nil {
+		return nil, err
+	}
+	fn := func(_ env.Environ[string], _, str string, err error) (string, error) {
+		if err != nil {
+			return "", err
+		}
+		bounds := boundaries(str)
+		if longest == prefix {
+			slices.Reverse(bounds)
+		}
+		for _, i := range bounds {
+			if prefix && re.MatchString(str[:i]) {
+				return str[i:], nil
+			}
+			if !prefix && re.MatchString(str[i:]) {
+				return str[:i], nil
+			}
+		}
+		return str, nil
+	}
+	return fn, nil
+}
+
+// expandReplace replaces the longest part of the value matching a pattern by
+// a replacement string. The first match is replaced unless the pattern starts
+// with a slash (all matches), a # (match at the start) or a % (match at the
+// end).
+func expandReplace(mod string) (expandFunc, error) {
+	var kind byte
+	if len(mod) > 0 && (mod[0] == '/' || mod[0] == '#' || mod[0] == '%') {
+		kind, mod = mod[0], mod[1:]
+	}
+	pattern, with, _ := strings.Cut(mod, "/")
+	if pattern == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+	re, err := compileGlob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	fn := func(_ env.Environ[string], _, str string, err error) (string, error) {
+		if err != nil {
+			return "", err
+		}
+		var (
+			bounds = boundaries(str)
+			buf    strings.Builder
+			last   int
+		)
+		for j := 0; j < len(bounds); j++ {
+			beg := bounds[j]
+			if beg < last || (kind == '#' && beg > 0) {
+				continue
+			}
+			for k := len(bounds) - 1; k > j; k-- {
+				end := bounds[k]
+				if kind == '%' && end != len(str) {
+					continue
+				}
+				if !re.MatchString(str[beg:end]) {
+					continue
+				}
+				buf.WriteString(str[last:beg])
+				buf.WriteString(with)
+				last = end
+				break
+			}
+			if last > 0 && kind != '/' {
+				break
+			}
+		}
+		buf.WriteString(str[last:])
+		return buf.String(), nil
+	}
+	return fn, nil
+}
+
+// boundaries gives the byte offsets of each character in str, including the
+// end of str.
+func boundaries(str string) []int {
+	var list []int
+	for i := range str {
+		list = append(list, i)
+	}
+	return append(list, len(str))
+}
+
+// compileGlob transforms a shell pattern into a regular expression matching
+// the full input given to it.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	var buf strings.Builder
+	buf.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			buf.WriteString("(?s:.*)")
+		case '?':
+			buf.WriteString("(?s:.)")
+		case '[':
+			j := strings.IndexByte(pattern[i:], ']')
+			if j < 0 {
+				return nil, fmt.Errorf("%s: unterminated character class", pattern)
+			}
+			class := pattern[i+1 : i+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + class + "]")
+			i += j
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			buf.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			buf.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
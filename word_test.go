@@ -0,0 +1,272 @@
+package mule
+
+import (
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/midbel/enjoy/env"
+)
+
+func testEnv() env.Environ[string] {
+	ev := env.EmptyEnv[string]()
+	ev.Define("name", "archive.tar.gz", false)
+	ev.Define("path", "/usr/local/bin/mule", false)
+	ev.Define("lower", "hello", false)
+	ev.Define("upper", "HELLO", false)
+	ev.Define("accent", "été", false)
+	ev.Define("empty", "", false)
+	return ev
+}
+
+func TestParseVariable(t *testing.T) {
+	tests := []struct {
+		Input string
+		Want  string
+		Fail  bool
+	}{
+		{Input: "name", Want: "archive.tar.gz"},
+		{Input: "missing:-default", Want: "default"},
+		{Input: "empty:-default", Want: "default"},
+		{Input: "name:-default", Want: "archive.tar.gz"},
+		{Input: "missing:=default", Want: "default"},
+		{Input: "name:+alternate", Want: "alternate"},
+		{Input: "missing:+alternate", Want: ""},
+		{Input: "name:?not set", Want: "archive.tar.gz"},
+		{Input: "missing:?not set", Fail: true},
+		{Input: "empty:?", Fail: true},
+		{Input: "name:8", Want: "tar.gz"},
+		{Input: "name:0:7", Want: "archive"},
+		{Input: "name: -2", Want: "gz"},
+		{Input: "name:0:-3", Want: "archive.tar"},
+		{Input: "name:20", Want: ""},
+		{Input: "accent:1:1", Want: "t"},
+		{Input: "lower^", Want: "Hello"},
+		{Input: "lower^^", Want: "HELLO"},
+		{Input: "upper,", Want: "hELLO"},
+		{Input: "upper,,", Want: "hello"},
+		{Input: "accent^", Want: "Été"},
+		{Input: "name#*.", Want: "tar.gz"},
+		{Input: "name##*.", Want: "gz"},
+		{Input: "name%.*", Want: "archive.tar"},
+		{Input: "name%%.*", Want: "archive"},
+		{Input: "name#foo", Want: "archive.tar.gz"},
+		{Input: "path/local/opt", Want: "/usr/opt/bin/mule"},
+		{Input: "name/./_", Want: "archive_tar.gz"},
+		{Input: "name//./_", Want: "archive_tar_gz"},
+		{Input: "name/#archive/file", Want: "file.tar.gz"},
+		{Input: "name/#tar/file", Want: "archive.tar.gz"},
+		{Input: "name/%gz/bz2", Want: "archive.tar.bz2"},
+		{Input: "name/a?c/X", Want: "Xhive.tar.gz"},
+		{Input: "name/[rt]ar/Y", Want: "archive.Y.gz"},
+		{Input: "name/.*", Want: "archive"},
+		{Input: "accent/é/e", Want: "eté"},
+		{Input: ":-default", Fail: true},
+		{Input: "name:first", Fail: true},
+		{Input: "name:0:last", Fail: true},
+		{Input: "name/", Fail: true},
+		{Input: "name#[a", Fail: true},
+		{Input: "name^x", Fail: true},
+	}
+	for _, tt := range tests {
+		w, err := parseVariable(tt.Input)
+		if err == nil {
+			var got string
+			if got, err = w.Expand(testEnv()); err == nil && !tt.Fail && got != tt.Want {
+				t.Errorf("%s: value mismatched! want %q, got %q", tt.Input, tt.Want, got)
+			}
+		}
+		if tt.Fail && err == nil {
+			t.Errorf("%s: expected error", tt.Input)
+		}
+		if !tt.Fail && err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.Input, err)
+		}
+	}
+}
+
+func TestParseVariableAssign(t *testing.T) {
+	ev := testEnv()
+	w, err := parseVariable("missing:=default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := w.Expand(ev); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	got, err := ev.Resolve("missing")
+	if err != nil || got != "default" {
+		t.Errorf("variable should have been assigned! want %q, got %q (%v)", "default", got, err)
+	}
+}
+
+func TestCompileGlob(t *testing.T) {
+	tests := []struct {
+		Pattern string
+		Input   string
+		Match   bool
+	}{
+		{Pattern: "*.go", Input: "main.go", Match: true},
+		{Pattern: "*.go", Input: "main.gox"},
+		{Pattern: "*", Input: "", Match: true},
+		{Pattern: "*", Input: "multi\nline", Match: true},
+		{Pattern: "?at", Input: "cat", Match: true},
+		{Pattern: "?at", Input: "at"},
+		{Pattern: "[bc]at", Input: "bat", Match: true},
+		{Pattern: "[bc]at", Input: "rat"},
+		{Pattern: "[!bc]at", Input: "rat", Match: true},
+		{Pattern: "[!bc]at", Input: "cat"},
+		{Pattern: "[a-c]x", Input: "bx", Match: true},
+		{Pattern: `\*`, Input: "*", Match: true},
+		{Pattern: `\*`, Input: "a"},
+		{Pattern: "a.b", Input: "a.b", Match: true},
+		{Pattern: "a.b", Input: "axb"},
+		{Pattern: "(a|b)+", Input: "(a|b)+", Match: true},
+		{Pattern: "été", Input: "été", Match: true},
+		{Pattern: "?té", Input: "été", Match: true},
+	}
+	for _, tt := range tests {
+		re, err := compileGlob(tt.Pattern)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.Pattern, err)
+			continue
+		}
+		if got := re.MatchString(tt.Input); got != tt.Match {
+			t.Errorf("%s: match %q mismatched! want %t, got %t", tt.Pattern, tt.Input, tt.Match, got)
+		}
+	}
+	for _, pattern := range []string{"[abc", "a[b"} {
+		if _, err := compileGlob(pattern); err == nil {
+			t.Errorf("%s: expected error", pattern)
+		}
+	}
+}
+
+func TestMergeURL(t *testing.T) {
+	tests := []struct {
+		Base  string
+		Child string
+		Want  string
+	}{
+		{Base: "http://localhost", Child: "/users", Want: "http://localhost/users"},
+		{Base: "http://localhost/", Child: "users", Want: "http://localhost/users"},
+		{Base: "http://localhost/api/", Child: "/users/", Want: "http://localhost/api/users/"},
+		{Base: "http://localhost/api", Child: "", Want: "http://localhost/api"},
+		{Base: "http://localhost/api", Child: "https://example.com/users", Want: "https://example.com/users"},
+		{Base: "http://localhost/api", Child: "//example.com/users", Want: "//example.com/users"},
+		{Base: "http://localhost?limit=10&page=1", Child: "users?page=2", Want: "http://localhost/users?limit=10&page=2"},
+		{Base: "http://localhost/api#top", Child: "users#list", Want: "http://localhost/api/users#list"},
+		{Base: "/api/v3", Child: "/pet", Want: "/api/v3/pet"},
+		{Base: "", Child: "pet", Want: "/pet"},
+	}
+	for _, tt := range tests {
+		base, _ := url.Parse(tt.Base)
+		child, _ := url.Parse(tt.Child)
+		got := mergeURL(base, child)
+		if got.String() != tt.Want {
+			t.Errorf("%s + %s: url mismatched! want %s, got %s", tt.Base, tt.Child, tt.Want, got)
+		}
+	}
+}
+
+func TestMergedURL(t *testing.T) {
+	tests := []struct {
+		Bases []string
+		Child string
+		Want  string
+	}{
+		{Bases: []string{"http://localhost/api"}, Child: "users", Want: "http://localhost/api/users"},
+		{Bases: []string{"v2", "http://localhost/api"}, Child: "users", Want: "http://localhost/api/v2/users"},
+		{Bases: []string{"users", "/v2", "/api"}, Child: "${id}", Want: "/api/v2/users/10"},
+		{Bases: []string{"", "/api/v3", "http://localhost"}, Child: "/pet", Want: "http://localhost/api/v3/pet"},
+		{Bases: []string{"/v2", "http://localhost/api"}, Child: "http://example.com/users", Want: "http://example.com/users"},
+		{Bases: []string{"http://example.com", "http://localhost/api"}, Child: "users", Want: "http://example.com/users"},
+	}
+	ev := env.EmptyEnv[string]()
+	ev.Define("id", "10", false)
+	for _, tt := range tests {
+		w, err := testWord(tt.Child)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.Child, err)
+			continue
+		}
+		for _, b := range tt.Bases {
+			var base Word
+			if b != "" {
+				base = createLiteral(b)
+			}
+			w = createMergedURL(base, w)
+		}
+		got, err := w.Expand(ev)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.Child, err)
+			continue
+		}
+		if got != tt.Want {
+			t.Errorf("%s: url mismatched! want %s, got %s", tt.Child, tt.Want, got)
+		}
+	}
+}
+
+func testWord(str string) (Word, error) {
+	if len(str) > 3 && str[0] == '$' && str[1] == '{' {
+		return parseVariable(str[2 : len(str)-1])
+	}
+	return createLiteral(str), nil
+}
+
+func TestUUID(t *testing.T) {
+	var (
+		word = createUUID()
+		re   = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	)
+	first, err := word.Expand(testEnv())
+	if err != nil {
+		t.Fatalf("unexpected error expanding uuid: %s", err)
+	}
+	second, err := word.Expand(testEnv())
+	if err != nil {
+		t.Fatalf("unexpected error expanding uuid: %s", err)
+	}
+	if first == second {
+		t.Errorf("uuid should be different on each expansion! got %s twice", first)
+	}
+	for _, str := range []string{first, second} {
+		if !re.MatchString(str) {
+			t.Errorf("%s: not a version 4 uuid", str)
+		}
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	defer func(fn func() time.Time) {
+		timeSource = fn
+	}(timeSource)
+
+	now := time.Date(2024, 3, 15, 10, 30, 45, 123000000, time.UTC)
+	timeSource = func() time.Time {
+		return now
+	}
+	tests := []struct {
+		Format Word
+		Want   string
+	}{
+		{Format: nil, Want: "2024-03-15T10:30:45Z"},
+		{Format: createLiteral("rfc3339"), Want: "2024-03-15T10:30:45Z"},
+		{Format: createLiteral("unix"), Want: "1710498645"},
+		{Format: createLiteral("UNIXMILLI"), Want: "1710498645123"},
+		{Format: createLiteral("2006-01-02"), Want: "2024-03-15"},
+		{Format: createLiteral("15:04:05.000"), Want: "10:30:45.123"},
+	}
+	for _, tt := range tests {
+		got, err := createTimestamp(tt.Format).Expand(testEnv())
+		if err != nil {
+			t.Errorf("%v: unexpected error expanding timestamp: %s", tt.Format, err)
+			continue
+		}
+		if got != tt.Want {
+			t.Errorf("%v: timestamp mismatched! want %s, got %s", tt.Format, tt.Want, got)
+		}
+	}
+}